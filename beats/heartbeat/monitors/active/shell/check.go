@@ -1,9 +1,14 @@
 package shell
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
 
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 	"github.com/elastic/beats/libbeat/common/match"
 )
 
@@ -12,11 +17,20 @@ var (
 	errNoneisMatched   = errors.New("None is matched")
 	errCriticalMatched = errors.New("The critical is matched")
 
+	errStderr           = errors.New("The command writes to stderr")
+	errExitCodeCritical = errors.New("The critical exit code is matched")
+	errExitCodeNotOk    = errors.New("The exit code is not ok")
+
 	Ok       = "ok"
+	Warning  = "warning"
 	Critical = "critical"
+	Unknown  = "unknown"
 )
 
-func makeValidator(config *Config) OutputCheck {
+// makeValidator returns the validation of each run. Once the output is truncated by the
+// max_bytes, the ok and critical matchers are matched by line against the whole stdout
+// while it's read.
+func makeValidator(config *Config) RunCheck {
 	checks := make(map[string]OutputCheck)
 	for _, ok := range config.Check.Response.Ok {
 		checks[Ok+ok.String()] = checkOutput(ok)
@@ -26,7 +40,52 @@ func makeValidator(config *Config) OutputCheck {
 		checks[Critical+critical.String()] = checkOutput(critical)
 	}
 
-	return checkAll(checks)
+	var validators []ResultCheck
+	if config.Check.Mode == nagiosMode {
+		validators = append(validators, checkNagios(config.Check.Nagios.WarningAs))
+	}
+
+	exitCodes := config.Check.ExitCode
+	if len(exitCodes.Ok) != 0 || len(exitCodes.Critical) != 0 {
+		validators = append(validators, checkExitCode(exitCodes))
+	}
+
+	if config.Check.Response.FailOnStderr {
+		validators = append(validators, checkStderr)
+	}
+
+	if config.Check.Response.JSON != nil {
+		validators = append(validators, checkJSON(config.Check.Response.JSON, int(config.Check.Response.MaxBytes)))
+	}
+
+	// the output has to match if nothing else is validated
+	matchOutput := len(checks) != 0 || len(validators) == 0
+	maxBytes := int(config.Check.Response.MaxBytes)
+	return func(req *util.RunRequest) ResultCheck {
+		if !matchOutput {
+			return checkResultAll(validators)
+		}
+		run := append([]ResultCheck{}, validators...)
+		if maxBytes > 0 {
+			scanner := newOutputScanner(checkAll(checks), maxBytes)
+			addOutput(req, scanner)
+			run = append(run, checkScannedOutput(checkAll(checks), scanner))
+		} else {
+			run = append(run, checkResultOutput(checkAll(checks)))
+		}
+		return checkResultAll(run)
+	}
+}
+
+func checkResultAll(checks []ResultCheck) ResultCheck {
+	return func(result *util.Result) error {
+		for _, check := range checks {
+			if err := check(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
 func checkAll(checks map[string]OutputCheck) OutputCheck {
@@ -48,6 +107,12 @@ func checkAll(checks map[string]OutputCheck) OutputCheck {
 
 type OutputCheck func(string) error
 
+// ResultCheck validates the result returned by a Client.
+type ResultCheck func(*util.Result) error
+
+// RunCheck returns the validation of a single run, it can stream the output of the request.
+type RunCheck func(*util.RunRequest) ResultCheck
+
 func checkOutput(c match.Matcher) OutputCheck {
 	return func(output string) error {
 		if c.MatchString(output) {
@@ -56,3 +121,175 @@ func checkOutput(c match.Matcher) OutputCheck {
 		return errDoesntmatch
 	}
 }
+
+func checkStderr(result *util.Result) error {
+	if result.Stderr != "" {
+		return errStderr
+	}
+	return nil
+}
+
+func checkResultOutput(check OutputCheck) ResultCheck {
+	return func(result *util.Result) error {
+		return check(result.Stdout)
+	}
+}
+
+// checkScannedOutput checks the whole stdout, or the lines scanned while it was read once it's truncated
+func checkScannedOutput(check OutputCheck, scanner *outputScanner) ResultCheck {
+	return func(result *util.Result) error {
+		if stdoutTruncated(result, scanner.max) {
+			return scanner.result()
+		}
+		return check(result.Stdout)
+	}
+}
+
+// stdoutTruncated tells whether the stdout of the result is longer than the max bytes
+func stdoutTruncated(result *util.Result, maxBytes int) bool {
+	return maxBytes > 0 && result.StdoutBytes > int64(maxBytes)
+}
+
+// addOutput streams the whole stdout of the request to w too
+func addOutput(req *util.RunRequest, w io.Writer) {
+	if req.Output == nil {
+		req.Output = w
+		return
+	}
+	req.Output = io.MultiWriter(req.Output, w)
+}
+
+// outputScanner runs the output check on each line of the output as it's written. A critical line
+// fails the check, otherwise an ok line passes it. The lines are cut at max bytes.
+type outputScanner struct {
+	check    OutputCheck
+	max      int
+	line     []byte
+	ok       bool
+	critical bool
+}
+
+func newOutputScanner(check OutputCheck, max int) *outputScanner {
+	return &outputScanner{check: check, max: max}
+}
+
+func (s *outputScanner) Write(p []byte) (int, error) {
+	rest := p
+	for len(rest) > 0 {
+		pos := bytes.IndexByte(rest, '\n')
+		if pos < 0 {
+			s.appendLine(rest)
+			break
+		}
+		s.appendLine(rest[:pos])
+		s.matchLine()
+		rest = rest[pos+1:]
+	}
+	return len(p), nil
+}
+
+func (s *outputScanner) appendLine(p []byte) {
+	if n := s.max - len(s.line); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		s.line = append(s.line, p[:n]...)
+	}
+}
+
+func (s *outputScanner) matchLine() {
+	switch s.check(string(s.line)) {
+	case nil:
+		s.ok = true
+	case errCriticalMatched:
+		s.critical = true
+	}
+	s.line = s.line[:0]
+}
+
+func (s *outputScanner) result() error {
+	if len(s.line) > 0 {
+		s.matchLine()
+	}
+	switch {
+	case s.critical:
+		return errCriticalMatched
+	case s.ok:
+		return nil
+	}
+	return errNoneisMatched
+}
+
+// checkExitCode fails if the exit code is in the critical ranges,
+// or if ok ranges are configured and none of them contains the exit code.
+func checkExitCode(config exitCodeConfig) ResultCheck {
+	// the ranges are verified by exitCodeConfig.Validate
+	oks, _ := parseExitCodeRanges(config.Ok)
+	criticals, _ := parseExitCodeRanges(config.Critical)
+
+	return func(result *util.Result) error {
+		for _, critical := range criticals {
+			if critical.contains(result.ExitCode) {
+				return errExitCodeCritical
+			}
+		}
+		if len(oks) == 0 {
+			return nil
+		}
+		for _, ok := range oks {
+			if ok.contains(result.ExitCode) {
+				return nil
+			}
+		}
+		return errExitCodeNotOk
+	}
+}
+
+// exitCodeRange is an inclusive range of exit codes, negated with a leading "!"
+type exitCodeRange struct {
+	from, to int
+	negate   bool
+}
+
+func (r exitCodeRange) contains(code int) bool {
+	in := code >= r.from && code <= r.to
+	if r.negate {
+		return !in
+	}
+	return in
+}
+
+func parseExitCodeRanges(values []string) ([]exitCodeRange, error) {
+	ranges := make([]exitCodeRange, 0, len(values))
+	for _, value := range values {
+		r, err := parseExitCodeRange(value)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseExitCodeRange(value string) (exitCodeRange, error) {
+	var r exitCodeRange
+	s := strings.TrimSpace(value)
+	if strings.Index(s, "!") == 0 {
+		r.negate = true
+		s = strings.TrimSpace(s[1:])
+	}
+
+	var err error
+	if pos := strings.Index(s, "-"); pos > 0 {
+		if r.from, err = strconv.Atoi(strings.TrimSpace(s[:pos])); err == nil {
+			r.to, err = strconv.Atoi(strings.TrimSpace(s[pos+1:]))
+		}
+	} else {
+		r.from, err = strconv.Atoi(s)
+		r.to = r.from
+	}
+	if err != nil || r.from > r.to {
+		return r, fmt.Errorf("Invalid exit code range '%v'", value)
+	}
+	return r, nil
+}
@@ -0,0 +1,82 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/libbeat/common/match"
+)
+
+func Test_exit_code_range(t *testing.T) {
+	tests := []struct {
+		value string
+		in    []int
+		out   []int
+	}{
+		{"0", []int{0}, []int{1, -1}},
+		{"1-2", []int{1, 2}, []int{0, 3}},
+		{"!0", []int{1, 2, 255}, []int{0}},
+		{"! 1-3", []int{0, 4}, []int{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		r, err := parseExitCodeRange(test.value)
+		assert.NoError(t, err, test.value)
+		for _, code := range test.in {
+			assert.True(t, r.contains(code), "%v should contain %v", test.value, code)
+		}
+		for _, code := range test.out {
+			assert.False(t, r.contains(code), "%v should not contain %v", test.value, code)
+		}
+	}
+
+	for _, value := range []string{"", "a", "3-1", "1-", "!"} {
+		_, err := parseExitCodeRange(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func Test_check_exit_code(t *testing.T) {
+	check := checkExitCode(exitCodeConfig{Ok: []string{"0"}, Critical: []string{"2-3"}})
+
+	assert.NoError(t, check(&util.Result{ExitCode: 0}))
+	assert.Equal(t, errExitCodeNotOk, check(&util.Result{ExitCode: 1}))
+	assert.Equal(t, errExitCodeCritical, check(&util.Result{ExitCode: 2}))
+
+	check = checkExitCode(exitCodeConfig{Critical: []string{"!0"}})
+	assert.NoError(t, check(&util.Result{ExitCode: 0}))
+	assert.Equal(t, errExitCodeCritical, check(&util.Result{ExitCode: 1}))
+}
+
+func Test_check_scanned_output(t *testing.T) {
+	config := defaultConfig()
+	config.Check.Response.Ok = []match.Matcher{match.MustCompile("ready")}
+	config.Check.Response.Critical = []match.Matcher{match.MustCompile("panic")}
+	config.Check.Response.MaxBytes = 16
+	validator := makeValidator(&config)
+
+	cases := []struct {
+		output string
+		err    error
+	}{
+		{"starting\nready\n", nil},
+		{strings.Repeat("x", 100) + "\nready\n" + strings.Repeat("y", 100), nil},
+		{"ready\n" + strings.Repeat("x", 100) + "\npanic: oops", errCriticalMatched},
+		{strings.Repeat("x", 100) + "\n" + strings.Repeat("y", 100), errNoneisMatched},
+		// a long line is matched by its first max bytes
+		{strings.Repeat("x", 100) + "ready\n", errNoneisMatched},
+	}
+	for _, c := range cases {
+		req := &util.RunRequest{MaxBytes: 16}
+		check := validator(req)
+		outputs := util.NewOutputs(req)
+		outputs.StdoutWriter.Write([]byte(c.output))
+
+		result := &util.Result{}
+		outputs.SetResult(result)
+		assert.Equal(t, c.err, check(result), c.output)
+	}
+}
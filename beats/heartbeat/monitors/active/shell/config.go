@@ -8,6 +8,11 @@ import (
 	"time"
 
 	"github.com/elastic/beats/heartbeat/monitors"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/local"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/ssh"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/libbeat/common/cfgtype"
 	"github.com/elastic/beats/libbeat/common/match"
 	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
 )
@@ -23,6 +28,14 @@ type Config struct {
 	Username string `config:"username"`
 	Password string `config:"password"`
 	Key      string `config:"key"`
+	// OpenSSH certificate of the key
+	Certificate string `config:"certificate"`
+	// ssh settings
+	SSH sshConfig `config:"ssh"`
+	// jump hosts in order, like the OpenSSH ProxyJump
+	ProxyJump []proxyJumpConfig `config:"proxy_jump"`
+	// settings of the commands run on localhost
+	Local localConfig `config:"local"`
 	// configure tls
 	TLS *tlscommon.Config `config:"ssl"`
 	// configure validation
@@ -30,39 +43,290 @@ type Config struct {
 	CustomeFields []string      `config:"custom"`
 	Timeout       time.Duration `config:"timeout"`
 
-	Docker       bool     `config:"docker"`
-	Dockerfilter []string `config:"dockerfilter"`
+	Docker       dockerConfig `config:"docker"`
+	Dockerfilter []string     `config:"dockerfilter"`
+}
+
+type sshConfig struct {
+	// Auth are the authentication methods in order, username with password or key are used without them
+	Auth []ssh.AuthMethod `config:"auth"`
+
+	// HostKeyPolicy is strict, tofu or insecure, it defaults to strict
+	HostKeyPolicy       string               `config:"host_key_policy"`
+	KnownHosts          string               `config:"known_hosts"`
+	HostKeyFingerprints []hostKeyFingerprint `config:"host_key_fingerprints"`
+	TOFUStateFile       string               `config:"tofu_state_file"`
+	// HostCAKeys are the CA public keys signing the host certificates
+	HostCAKeys []string `config:"host_ca_keys"`
+
+	Pool      poolConfig      `config:"pool"`
+	Keepalive keepaliveConfig `config:"keepalive"`
+}
+
+// keepaliveConfig closes the connection after max missed keepalives, 0 disables the keepalives or the limit
+type keepaliveConfig struct {
+	Interval  time.Duration `config:"interval" validate:"min=0"`
+	MaxMissed int           `config:"max_missed" validate:"min=0"`
+}
+
+// poolConfig limits the connection shared by the monitors of the same host, user and credentials
+type poolConfig struct {
+	MaxSessions int           `config:"max_sessions" validate:"min=0"`
+	IdleTimeout time.Duration `config:"idle_timeout" validate:"min=0"`
+}
+
+// proxyJumpConfig is a jump host with its own credentials and host key settings
+type proxyJumpConfig struct {
+	Host        string    `config:"host" validate:"required"`
+	Username    string    `config:"username" validate:"required"`
+	Password    string    `config:"password"`
+	Key         string    `config:"key"`
+	Certificate string    `config:"certificate"`
+	SSH         sshConfig `config:"ssh"`
+}
+
+// dockerConfig is `docker: true`, or the docker settings like `docker.discovery: true`
+type dockerConfig struct {
+	Enabled bool
+	// Discovery runs the check in each running container matching the dockerfilter
+	Discovery bool
+	// APIVersion pins the version of the docker api, it's negotiated with the daemon by default
+	APIVersion string
+	// IdleTimeout closes the clients and the forwarded socket once no check used them that long
+	IdleTimeout time.Duration
+	// Exec are the settings of the execs running the checks
+	Exec dockerExecConfig
+}
+
+// dockerExecConfig is `docker.exec.mode` and the settings of each exec in per_command mode
+type dockerExecConfig struct {
+	// Mode is shell for a single long-lived shell, or per_command for a new exec by each check
+	Mode       string
+	User       string
+	Env        []string
+	WorkingDir string
+}
+
+func (c *dockerConfig) Unpack(value interface{}) error {
+	switch v := value.(type) {
+	case bool:
+		c.Enabled = v
+		return nil
+	case map[string]interface{}:
+		c.Enabled = true
+		for key, option := range v {
+			switch key {
+			case "enabled", "discovery":
+				enabled, ok := option.(bool)
+				if !ok {
+					return fmt.Errorf("The docker.%v setting must be a bool", key)
+				}
+				if key == "enabled" {
+					c.Enabled = enabled
+				} else {
+					c.Discovery = enabled
+				}
+			case "api_version":
+				version, ok := option.(string)
+				if !ok {
+					return fmt.Errorf("The docker.api_version setting must be a string like \"1.24\"")
+				}
+				c.APIVersion = version
+			case "idle_timeout":
+				timeout, ok := option.(string)
+				if !ok {
+					return fmt.Errorf("The docker.idle_timeout setting must be a duration like \"5m\"")
+				}
+				idle, err := time.ParseDuration(timeout)
+				if err != nil || idle < 0 {
+					return fmt.Errorf("The docker.idle_timeout setting must be a duration like \"5m\"")
+				}
+				c.IdleTimeout = idle
+			case "exec":
+				if err := c.Exec.unpack(option); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("Unsupported docker setting '%v'", key)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("The docker setting must be a bool or the docker settings")
+}
+
+func (c *dockerExecConfig) unpack(value interface{}) error {
+	settings, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("The docker.exec setting must be the exec settings")
+	}
+	for key, option := range settings {
+		switch key {
+		case "mode", "user", "working_dir":
+			text, ok := option.(string)
+			if !ok {
+				return fmt.Errorf("The docker.exec.%v setting must be a string", key)
+			}
+			switch key {
+			case "mode":
+				c.Mode = text
+			case "user":
+				c.User = text
+			default:
+				c.WorkingDir = text
+			}
+		case "env":
+			values, ok := option.([]interface{})
+			if !ok {
+				return fmt.Errorf("The docker.exec.env setting must be a list like [\"KEY=value\"]")
+			}
+			c.Env = make([]string, 0, len(values))
+			for _, v := range values {
+				env, ok := v.(string)
+				if !ok {
+					return fmt.Errorf("The docker.exec.env setting must be a list like [\"KEY=value\"]")
+				}
+				c.Env = append(c.Env, env)
+			}
+		default:
+			return fmt.Errorf("Unsupported docker.exec setting '%v'", key)
+		}
+	}
+	return nil
+}
+
+// localConfig isolates the commands run on localhost from the beat
+type localConfig struct {
+	// RunAs is the user or user:group running the commands
+	RunAs  string       `config:"run_as"`
+	Limits limitsConfig `config:"limits"`
+	// Sandbox runs the commands in new mount, pid and net namespaces with their own /proc
+	Sandbox bool `config:"sandbox"`
+}
+
+// limitsConfig are the rlimits of the commands, 0 is unlimited
+type limitsConfig struct {
+	CPU       time.Duration    `config:"cpu" validate:"min=0"`
+	Memory    cfgtype.ByteSize `config:"memory" validate:"min=0"`
+	OpenFiles uint64           `config:"open_files"`
+	Processes uint64           `config:"processes"`
+}
+
+// hostKeyFingerprint pins the SHA256 fingerprint of a host or host:port
+type hostKeyFingerprint struct {
+	Host        string `config:"host" validate:"required"`
+	Fingerprint string `config:"fingerprint" validate:"required"`
 }
 
 type checkConfig struct {
-	Request  commandConfig `config:"request"`
-	Response outputConfig  `config:"output"`
+	// Mode is empty or nagios for running nagios plugins
+	Mode     string         `config:"mode"`
+	Nagios   nagiosConfig   `config:"nagios"`
+	Request  commandConfig  `config:"request"`
+	Response outputConfig   `config:"output"`
+	ExitCode exitCodeConfig `config:"exit_code"`
+	// Docker checks the state of the container, the request is only run if it has a command or script
+	Docker *dockerCheckConfig `config:"docker"`
+}
+
+// nagiosConfig are the settings of the nagios mode
+type nagiosConfig struct {
+	// WarningAs is the monitor status of a warning, up or down
+	WarningAs string `config:"warning_as"`
+}
+
+// dockerCheckConfig asserts on the state of the container reported by the docker api
+type dockerCheckConfig struct {
+	// State are the accepted states, running by default
+	State []string `config:"state"`
+	// Health are the accepted HEALTHCHECK statuses, any but unhealthy by default
+	Health []string `config:"health"`
+	// MaxRestarts fails the check once the container restarted more often, unlimited without value
+	MaxRestarts *int `config:"max_restarts" validate:"min=0"`
+	// FailOnOOMKilled fails the check if the last exit of the container was an OOM kill
+	FailOnOOMKilled bool `config:"fail_on_oom_killed"`
+	// MinUptime fails the check until the container has been running that long
+	MinUptime time.Duration `config:"min_uptime" validate:"min=0"`
 }
 
 type commandConfig struct {
 	Command string   `config:"command"`
 	Args    []string `config:"args"`
 	Dir     string   `config:"dir"`
+	// Shell runs the command as a raw shell snippet, otherwise the command and args are an argv.
+	// The args are always quoted. It's the default over ssh and docker, not on localhost.
+	Shell *bool `config:"shell"`
+	// Env is the environment of the command, ${VAR} references are resolved
+	// from the beat environment and keystore when the config is loaded.
+	Env map[string]string `config:"env"`
+	// Script is an inline script or @file run by the Interpreter instead of the command,
+	// the args are passed to the script.
+	Script      string `config:"script"`
+	Interpreter string `config:"interpreter"`
+	// Stdin is an inline value or @file streamed to the stdin of the command
+	Stdin string `config:"stdin"`
+}
+
+// shell tells whether the command is a shell snippet, by default for the remote shells
+func (c *commandConfig) shell(remote bool) bool {
+	if c.Shell == nil {
+		return remote
+	}
+	return *c.Shell
 }
 
 type outputConfig struct {
 	Ok       []match.Matcher `config:"ok"`
 	Critical []match.Matcher `config:"critical"`
+	JSON     *jsonConfig     `config:"json"`
+	// fail the check if the command writes anything to stderr
+	FailOnStderr bool `config:"fail_on_stderr"`
+	// MaxBytes keeps the head and the tail of each output up to max bytes, 0 is unlimited
+	MaxBytes cfgtype.ByteSize `config:"max_bytes" validate:"min=0"`
 }
 
+// jsonConfig decodes the output as JSON and checks assertions like `status == "green"`
+type jsonConfig struct {
+	Assertions []string `config:"assertions"`
+}
+
+// exitCodeConfig holds exit codes or ranges like "0", "1-2" or "!0"
+type exitCodeConfig struct {
+	Ok       []string `config:"ok"`
+	Critical []string `config:"critical"`
+}
+
+// defaultDockerIdleTimeout keeps the docker clients open between the checks of the usual schedules
+const defaultDockerIdleTimeout = 5 * time.Minute
+
 // defaultConfig creates a new copy of the monitors default configuration.
 func defaultConfig() Config {
 	return Config{
-		Name:         "echo",
-		Hosts:        []string{"localhost:22"},
-		Mode:         monitors.DefaultIPSettings,
-		TLS:          nil,
-		Timeout:      16 * time.Second,
-		Docker:       false,
+		Name:    "echo",
+		Hosts:   []string{"localhost:22"},
+		Mode:    monitors.DefaultIPSettings,
+		TLS:     nil,
+		Timeout: 16 * time.Second,
+		Docker: dockerConfig{
+			IdleTimeout: defaultDockerIdleTimeout,
+			Exec:        dockerExecConfig{Mode: docker.ExecModeShell},
+		},
 		Dockerfilter: []string{},
+		SSH: sshConfig{
+			Pool: poolConfig{
+				MaxSessions: ssh.DefaultMaxSessions,
+				IdleTimeout: ssh.DefaultIdleTimeout,
+			},
+			Keepalive: keepaliveConfig{
+				Interval:  ssh.DefaultKeepaliveInterval,
+				MaxMissed: ssh.DefaultKeepaliveMaxMissed,
+			},
+		},
 		Check: checkConfig{
+			Nagios: nagiosConfig{WarningAs: "up"},
 			Request: commandConfig{
-				Dir: "",
+				Dir:         "",
+				Interpreter: util.DefaultInterpreter,
 			},
 			Response: outputConfig{},
 		},
@@ -71,10 +335,30 @@ func defaultConfig() Config {
 
 func (c *Config) Validate() error {
 
-	if c.Docker {
+	if c.Check.Docker != nil && !c.Docker.Enabled {
+		return fmt.Errorf("The check.docker settings require docker")
+	}
+	if c.Docker.Enabled {
 		if len(c.Dockerfilter) == 0 {
 			return fmt.Errorf("The dockerfiler is required for docker shell command")
 		}
+		if mode := c.Docker.Exec.Mode; mode != docker.ExecModeShell && mode != docker.ExecModePerCommand {
+			return fmt.Errorf("Unsupported docker.exec.mode '%v'", mode)
+		}
+		for _, addr := range c.Hosts {
+			if c.TLS.IsEnabled() && !strings.HasPrefix(addr, "tcp://") {
+				return fmt.Errorf("The ssl settings require a tcp:// docker endpoint, not %v", addr)
+			}
+			if strings.HasPrefix(addr, sshEndpointPrefix) {
+				_, username, _, err := parseSSHEndpoint(addr, c.Username)
+				if err != nil {
+					return err
+				}
+				if err := c.validateSSH(username); err != nil {
+					return err
+				}
+			}
+		}
 	} else {
 		for _, addr := range c.Hosts {
 			host, _, err := net.SplitHostPort(addr)
@@ -83,34 +367,147 @@ func (c *Config) Validate() error {
 			}
 
 			if strings.ToLower(host) != "localhost" {
-				if c.Username == "" {
-					return fmt.Errorf("Username is required")
+				if err := c.validateSSH(c.Username); err != nil {
+					return err
 				}
+			}
 
-				if c.Password == "" && c.Key == "" {
-					return fmt.Errorf("Either Password and key is required")
-				}
-				if strings.Index(c.Key, "@") == 0 {
-					_, err := os.Stat(string(c.Key[1:]))
-					if err != nil {
-						return err
-					}
+		}
 
-				}
-			}
+	}
+
+	return nil
+}
 
+// validateSSH checks the credentials of the ssh hosts, and of the docker endpoints reached through ssh
+func (c *Config) validateSSH(username string) error {
+	if username == "" {
+		return fmt.Errorf("Username is required")
+	}
+
+	if c.Password == "" && c.Key == "" && len(c.SSH.Auth) == 0 {
+		return fmt.Errorf("Either Password, key or ssh.auth is required")
+	}
+	if strings.Index(c.Key, "@") == 0 {
+		_, err := os.Stat(string(c.Key[1:]))
+		if err != nil {
+			return err
 		}
 
 	}
+	return validateCertificate(c.Key, c.Certificate)
+}
+
+func (c *proxyJumpConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		return err
+	}
+	if c.Password == "" && c.Key == "" && len(c.SSH.Auth) == 0 {
+		return fmt.Errorf("Either Password, key or ssh.auth is required for the proxy jump %v", c.Host)
+	}
+	return validateCertificate(c.Key, c.Certificate)
+}
+
+func validateCertificate(key, certificate string) error {
+	if certificate == "" {
+		return nil
+	}
+	if key == "" {
+		return fmt.Errorf("The key is required for the certificate")
+	}
+	if strings.Index(certificate, "@") == 0 {
+		if _, err := os.Stat(certificate[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sshConfig) Validate() error {
+	switch c.HostKeyPolicy {
+	case "", ssh.HostKeyStrict, ssh.HostKeyInsecure:
+	case ssh.HostKeyTOFU:
+		if c.TOFUStateFile == "" {
+			return fmt.Errorf("The tofu_state_file is required for the tofu host key policy")
+		}
+	default:
+		return fmt.Errorf("Unsupported host_key_policy '%v'", c.HostKeyPolicy)
+	}
+	if c.KnownHosts != "" {
+		if _, err := os.Stat(c.KnownHosts); err != nil {
+			return err
+		}
+	}
+	for _, key := range c.HostCAKeys {
+		if strings.Index(key, "@") == 0 {
+			if _, err := os.Stat(key[1:]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pin := range c.HostKeyFingerprints {
+		if strings.Index(pin.Fingerprint, "SHA256:") != 0 {
+			return fmt.Errorf("The fingerprint of %v must be a SHA256 fingerprint", pin.Host)
+		}
+	}
+	return nil
+}
 
+func (c *localConfig) Validate() error {
+	if c.RunAs != "" {
+		return local.CheckRunAs(c.RunAs)
+	}
 	return nil
 }
 
 func (c *checkConfig) Validate() error {
+	if c.Mode != "" && c.Mode != nagiosMode {
+		return fmt.Errorf("Unsupported check mode '%v'", c.Mode)
+	}
+	return nil
+}
+
+func (c *nagiosConfig) Validate() error {
+	if c.WarningAs != "up" && c.WarningAs != "down" {
+		return fmt.Errorf("Unsupported nagios.warning_as '%v', it's up or down", c.WarningAs)
+	}
+	return nil
+}
+
+func (c *dockerCheckConfig) Validate() error {
+	for _, state := range c.State {
+		switch state {
+		case "created", "running", "paused", "restarting", "removing", "exited", "dead":
+		default:
+			return fmt.Errorf("Unsupported container state '%v'", state)
+		}
+	}
+	for _, health := range c.Health {
+		switch health {
+		case "starting", "healthy", "unhealthy", "none":
+		default:
+			return fmt.Errorf("Unsupported container health '%v'", health)
+		}
+	}
 	return nil
 }
 
 func (c *commandConfig) Validate() error {
+	if c.Script != "" && c.Command != "" {
+		return fmt.Errorf("Either command or script is allowed")
+	}
+	for _, file := range []string{c.Script, c.Stdin} {
+		if strings.Index(file, "@") == 0 {
+			if _, err := os.Stat(file[1:]); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range c.Env {
+		if !util.ValidEnvName(name) {
+			return fmt.Errorf("Invalid environment variable name '%v'", name)
+		}
+	}
 	return nil
 }
 
@@ -118,3 +515,19 @@ func (c *outputConfig) Validate() error {
 	return nil
 
 }
+
+func (c *jsonConfig) Validate() error {
+	_, err := parseJSONAssertions(c.Assertions)
+	return err
+}
+
+func (c *exitCodeConfig) Validate() error {
+	for _, values := range [][]string{c.Ok, c.Critical} {
+		for _, value := range values {
+			if _, err := parseExitCodeRange(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
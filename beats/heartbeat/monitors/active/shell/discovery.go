@@ -0,0 +1,147 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/elastic/beats/heartbeat/monitors"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// newDiscoveryJob runs the check in each running container matching the dockerfilter of the
+// endpoint, every container reports its own event. The containers started and stopped between
+// the runs are checked from the next run. The discovery and the clients are closed once idle.
+func newDiscoveryJob(
+	settings monitors.JobSettings,
+	addr string,
+	config *Config,
+	run func(cmd shellComm) (common.MapStr, error),
+) (monitors.Job, error) {
+	var (
+		api       *dockerAPI
+		discovery *docker.Discovery
+		clients   *containerClients
+	)
+	idle, err := openIdle(config.Docker.IdleTimeout, func() (func(), error) {
+		var err error
+		api, err = openDockerAPI(addr, config)
+		if err != nil {
+			return nil, err
+		}
+		discovery = docker.NewDiscovery(api.endpoint, config.Dockerfilter, config.Timeout)
+		discovery.TLS = api.tls
+		discovery.APIVersion = config.Docker.APIVersion
+		clients = newContainerClients(func(id string) *docker.DockerClient {
+			client := api.client(config)
+			client.ContainerID = id
+			return client
+		})
+		return func() {
+			discovery.Close()
+			clients.keep(nil)
+			api.Close()
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return monitors.MakeJob(settings, func() (common.MapStr, []monitors.TaskRunner, error) {
+		done, err := idle.use()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer done()
+		containers, err := discovery.Containers()
+		if err != nil {
+			err = api.err(err)
+			if sshErr := sshFailure(err); sshErr != nil {
+				return nil, nil, sshErr
+			}
+			return nil, nil, err
+		}
+		clients.keep(containers)
+		if len(containers) == 0 {
+			return nil, nil, fmt.Errorf("No running container matches the dockerfilter %v", config.Dockerfilter)
+		}
+
+		tasks := make([]monitors.TaskRunner, 0, len(containers))
+		for _, container := range containers {
+			client := api.comm(clients.get(container.ID))
+			fields := containerFields(container)
+			// the clients are kept open until the task of each container ran
+			taskDone := idle.retain()
+			tasks = append(tasks, monitors.MakeSimpleCont(func() (common.MapStr, error) {
+				defer taskDone()
+				event, err := run(client)
+				if event == nil {
+					event = common.MapStr{}
+				}
+				event.DeepUpdate(fields)
+				return event, err
+			}))
+		}
+		return nil, tasks, nil
+	}), nil
+}
+
+// containerClients are the clients of the discovered containers by id
+type containerClients struct {
+	mutex   sync.Mutex
+	clients map[string]*docker.DockerClient
+	create  func(id string) *docker.DockerClient
+}
+
+func newContainerClients(create func(id string) *docker.DockerClient) *containerClients {
+	return &containerClients{clients: map[string]*docker.DockerClient{}, create: create}
+}
+
+func (c *containerClients) get(id string) *docker.DockerClient {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	client, ok := c.clients[id]
+	if !ok {
+		client = c.create(id)
+		c.clients[id] = client
+	}
+	return client
+}
+
+// keep closes the clients of the containers which are gone
+func (c *containerClients) keep(containers []types.Container) {
+	running := map[string]bool{}
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, client := range c.clients {
+		if !running[id] {
+			client.Close()
+			delete(c.clients, id)
+		}
+	}
+}
+
+// containerFields describes the container like the add_docker_metadata processor, the dots of
+// the label names are replaced
+func containerFields(container types.Container) common.MapStr {
+	labels := common.MapStr{}
+	for name, value := range container.Labels {
+		labels[strings.Replace(name, ".", "_", -1)] = value
+	}
+	return common.MapStr{
+		"docker": common.MapStr{
+			"container": common.MapStr{
+				"id":     container.ID,
+				"name":   docker.ContainerName(container),
+				"image":  container.Image,
+				"labels": labels,
+			},
+		},
+	}
+}
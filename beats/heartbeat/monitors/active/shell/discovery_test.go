@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func Test_docker_config(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		want  dockerConfig
+	}{
+		{true, dockerConfig{Enabled: true}},
+		{false, dockerConfig{}},
+		{map[string]interface{}{"discovery": true}, dockerConfig{Enabled: true, Discovery: true}},
+		{map[string]interface{}{"enabled": false, "discovery": true}, dockerConfig{Discovery: true}},
+		{map[string]interface{}{"api_version": "1.24"}, dockerConfig{Enabled: true, APIVersion: "1.24"}},
+		{map[string]interface{}{"idle_timeout": "30s"}, dockerConfig{Enabled: true, IdleTimeout: 30 * time.Second}},
+		{
+			map[string]interface{}{"exec": map[string]interface{}{"mode": "per_command", "user": "nobody", "env": []interface{}{"LANG=C"}, "working_dir": "/app"}},
+			dockerConfig{Enabled: true, Exec: dockerExecConfig{Mode: "per_command", User: "nobody", Env: []string{"LANG=C"}, WorkingDir: "/app"}},
+		},
+	}
+	for _, c := range cases {
+		var config dockerConfig
+		assert.NoError(t, config.Unpack(c.value), "%v", c.value)
+		assert.Equal(t, c.want, config, "%v", c.value)
+	}
+
+	for _, value := range []interface{}{"yes", map[string]interface{}{"discovery": "yes"}, map[string]interface{}{"swarm": true}, map[string]interface{}{"api_version": true}, map[string]interface{}{"idle_timeout": "soon"},
+		map[string]interface{}{"exec": "per_command"}, map[string]interface{}{"exec": map[string]interface{}{"env": "LANG=C"}}, map[string]interface{}{"exec": map[string]interface{}{"privileged": true}}} {
+		var config dockerConfig
+		assert.Error(t, config.Unpack(value), "%v", value)
+	}
+}
+
+func Test_container_fields(t *testing.T) {
+	fields := containerFields(types.Container{
+		ID:     "0123456789ab",
+		Names:  []string{"/web_1"},
+		Image:  "nginx:1.15",
+		Labels: map[string]string{"com.docker.compose.service": "web"},
+	})
+	assert.Equal(t, common.MapStr{
+		"docker": common.MapStr{
+			"container": common.MapStr{
+				"id":     "0123456789ab",
+				"name":   "web_1",
+				"image":  "nginx:1.15",
+				"labels": common.MapStr{"com_docker_compose_service": "web"},
+			},
+		},
+	}, fields)
+}
+
+func Test_container_clients(t *testing.T) {
+	created := 0
+	clients := newContainerClients(func(id string) *docker.DockerClient {
+		created++
+		client := docker.NewDockerClient()
+		client.ContainerID = id
+		return client
+	})
+
+	web1 := clients.get("1")
+	assert.True(t, web1 == clients.get("1"))
+	clients.get("2")
+	assert.Equal(t, 2, created)
+
+	// the client of a stopped container is closed
+	clients.keep([]types.Container{{ID: "2"}})
+	assert.Len(t, clients.clients, 1)
+	assert.False(t, web1 == clients.get("1"))
+	assert.Equal(t, 3, created)
+}
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -22,15 +21,15 @@ func (d *DockerClient) copyFilesToContainer(filePath string, dstPath string, mod
 		return err
 	}
 
-	defer d.Close()
 	_, name := filepath.Split(filePath)
 
-	if _, err := d.Run("", "mkdir", "-p", dstPath); err != nil {
+	if err := d.runAction("mkdir", "-p", dstPath); err != nil {
 		return err
 	}
 	if err := tarFile(filePath); err != nil {
 		return err
 	}
+	defer os.Remove(filePath + ".tar")
 	id, _, err := d.getContainerIDAndState()
 	if err != nil {
 		return err
@@ -42,19 +41,28 @@ func (d *DockerClient) copyFilesToContainer(filePath string, dstPath string, mod
 	if err != nil {
 		return err
 	}
+	defer fromFile.Close()
 
 	err = d.dockerClient.CopyToContainer(ctx, id, dstPath, fromFile, types.CopyToContainerOptions{AllowOverwriteDirWithFile: true})
 	if err != nil {
 		return err
 	}
-	if _, err := d.Run("", "chmod", mode, filepath.Join(dstPath, name+".tar")); err != nil {
+	if err := d.runAction("chmod", mode, filepath.Join(dstPath, name+".tar")); err != nil {
 		return err
 	}
-	if _, err := d.Run("", "mv", filepath.Join(dstPath, name+".tar"), filepath.Join(dstPath, name)); err != nil {
+	return d.runAction("mv", filepath.Join(dstPath, name+".tar"), filepath.Join(dstPath, name))
+}
+
+// runAction runs the command as an argv, a non zero exit code is an error
+func (d *DockerClient) runAction(command string, args ...string) error {
+	result, err := d.Run("", command, args...)
+	if err != nil {
 		return err
 	}
-
-	return os.Remove(filePath + ".tar")
+	if result.ExitCode != 0 {
+		return fmt.Errorf("%v failed with the exit code %v: %v", command, result.ExitCode, result.Stderr)
+	}
+	return nil
 }
 
 func tarFile(filePath string) error {
@@ -64,7 +72,7 @@ func tarFile(filePath string) error {
 	}
 	_, name := filepath.Split(filePath)
 
-	tarFile, err := os.OpenFile(filePath+".tar", os.O_CREATE|os.O_WRONLY, 0666)
+	tarFile, err := os.OpenFile(filePath+".tar", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
@@ -110,12 +118,10 @@ func (d *DockerClient) getContainerBriefDetails(all bool) (types.Container, erro
 	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
 	defer cancel()
 
-	filter := filters.NewArgs()
-	for _, value := range d.Filter {
-		kv := strings.Split(value, ":")
-		if len(kv) == 2 {
-			filter.Add(kv[0], kv[1])
-		}
+	filter := filterArgs(d.Filter)
+	if d.ContainerID != "" {
+		filter = filters.NewArgs()
+		filter.Add("id", d.ContainerID)
 	}
 	d.actionMutex.RLock()
 	containers, err := d.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: all, Filters: filter})
@@ -123,6 +129,9 @@ func (d *DockerClient) getContainerBriefDetails(all bool) (types.Container, erro
 	if err != nil {
 		return types.Container{}, err
 	}
+	if len(containers) == 0 && d.ContainerID != "" {
+		return types.Container{}, fmt.Errorf("Container %v doesnot exist", d.ContainerID)
+	}
 	if len(containers) == 0 {
 		return types.Container{}, fmt.Errorf("Container %v doesnot exist", d.Filter)
 	}
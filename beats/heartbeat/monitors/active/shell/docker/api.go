@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	dclient "github.com/docker/docker/client"
+)
+
+// newHTTPClient is the http client of a daemon with tls like tcp://host:2376, nil for the
+// default client of the endpoint without tls
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+// negotiateVersion lowers the api version of the client to the version of the daemon, the older
+// daemons refuse the newer versions. The version is kept if the daemon can't be reached.
+func negotiateVersion(client *dclient.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ping, err := client.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	client.NegotiateAPIVersionPing(ping)
+	return nil
+}
@@ -0,0 +1,20 @@
+package docker
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_new_http_client(t *testing.T) {
+	assert.Nil(t, newHTTPClient(nil))
+
+	tlsConfig := &tls.Config{ServerName: "docker.example.com"}
+	client := newHTTPClient(tlsConfig)
+	transport, ok := client.Transport.(*http.Transport)
+	if assert.True(t, ok) {
+		assert.Equal(t, tlsConfig, transport.TLSClientConfig)
+	}
+}
@@ -2,12 +2,16 @@ package docker
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	dclient "github.com/docker/docker/client"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 )
 
 const (
@@ -23,13 +27,37 @@ type DockerClient struct {
 	execClientOnce *sync.Once
 	execErr        error
 	commandMutex   *sync.RWMutex
+	// connectTime is the start of the long-lived shell by the last run, 0 if it was running
+	connectTime time.Duration
 
 	actionMutex *sync.RWMutex
 
+	// httpClient is shared by the clients created by CheckClient, nil without TLS
+	httpClient *http.Client
+	// apiVersion is the version negotiated with the daemon by the first client
+	apiVersion string
+
 	name     string
 	Endpoint string
-	Filter   []string
-	Timeout  time.Duration
+	// TLS is the client config of a daemon with tls, nil for a plain endpoint
+	TLS *tls.Config
+	// APIVersion pins the version of the docker api, it's negotiated with the daemon if empty
+	APIVersion string
+	Filter     []string
+	// ContainerID selects the container by id instead of the Filter, like a discovered container
+	ContainerID string
+	Timeout     time.Duration
+	// Shell runs the command as a raw shell snippet, otherwise it's quoted like the args
+	Shell bool
+	// CommandEnv is the environment of the commands, in both exec modes
+	CommandEnv map[string]string
+
+	// ExecMode is ExecModeShell or ExecModePerCommand
+	ExecMode string
+	// User, Env and WorkingDir are set on each exec in ExecModePerCommand
+	User       string
+	Env        []string
+	WorkingDir string
 }
 
 func NewDockerClient() *DockerClient {
@@ -38,30 +66,54 @@ func NewDockerClient() *DockerClient {
 	d.execClientOnce = &sync.Once{}
 	d.actionMutex = &sync.RWMutex{}
 	d.commandMutex = &sync.RWMutex{}
+	d.ExecMode = ExecModeShell
+	d.Shell = true
 	return d
 }
 
 func (d *DockerClient) client() error {
 	d.dockerClientOnce.Do(func() {
-		var err error
+		if d.httpClient == nil {
+			d.httpClient = newHTTPClient(d.TLS)
+		}
+		version := d.APIVersion
+		if version == "" {
+			version = d.apiVersion
+		}
 
-		d.dockerClient, err = dclient.NewClient(d.Endpoint, "", nil, nil)
+		client, err := dclient.NewClient(d.Endpoint, version, d.httpClient, nil)
 		if err != nil {
 			d.dockerClientErr = err
+			return
 		}
-
+		if version == "" && negotiateVersion(client, d.Timeout) == nil {
+			d.apiVersion = client.ClientVersion()
+		}
+		if d.dockerClient != nil {
+			// the idle connections of the replaced client would be kept open, like the
+			// channels of a socket forwarded through ssh
+			d.dockerClient.Close()
+		}
+		d.dockerClient = client
+		d.dockerClientErr = nil
 	})
 	return d.dockerClientErr
 }
 
-//CheckClient check whether the client is connected.
+// CheckClient check whether the client is connected.
 func (d *DockerClient) CheckClient() error {
 	d.dockerClientOnce = &sync.Once{}
 	return d.client()
 }
 
 func (d *DockerClient) Connect() error {
+	if d.ExecMode == ExecModePerCommand {
+		// the execs are created by each Run
+		return d.client()
+	}
 	d.execClientOnce.Do(func() {
+		start := time.Now()
+		defer func() { d.connectTime = time.Since(start) }()
 		err := d.CheckClient()
 		if err != nil {
 			d.execErr = err
@@ -79,13 +131,13 @@ func (d *DockerClient) Connect() error {
 		d.actionMutex.Lock()
 		defer d.actionMutex.Unlock()
 
-		resp, err := client.ContainerExecCreate(ctx, containerDetail.ID, types.ExecConfig{AttachStderr: true, AttachStdin: true, AttachStdout: true, Tty: false, Detach: false, Cmd: []string{execLinuxCommand}})
+		resp, err := client.ContainerExecCreate(ctx, containerDetail.ID, types.ExecConfig{AttachStderr: true, AttachStdin: true, AttachStdout: true, Tty: false, Detach: false, Env: util.EnvList(d.CommandEnv), Cmd: []string{execLinuxCommand}})
 		if err != nil {
 			d.execErr = err
 			return
 		}
-		// It might need to be changed to type.ExecConfig for the older docker api
-		//https://github.com/docker/docker-ce/commit/016304f34671d1e4b9dbe93130700f6c9d2268f6#diff-fb5277a57b9d79722513466ad8a988da
+		// The older daemons accept ExecStartCheck too, the api version of the client is
+		// negotiated with them or pinned by APIVersion.
 		attachOutput, err := client.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{Detach: false, Tty: false})
 		if err != nil {
 			d.execErr = err
@@ -105,9 +157,14 @@ func (d *DockerClient) Reconnect() error {
 	return d.Connect()
 }
 
+// Close stops the long-lived shell and closes the idle connections of the docker api, the next
+// run connects again.
 func (d *DockerClient) Close() {
 	d.execClientOnce = &sync.Once{}
 	d.execErr = nil
+	if d.dockerClient != nil {
+		d.dockerClient.Close()
+	}
 	if d.hijackedResponse == nil {
 		return
 	}
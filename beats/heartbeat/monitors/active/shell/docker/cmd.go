@@ -1,106 +1,153 @@
 package docker
 
 import (
-	"bufio"
-	"encoding/binary"
-	"errors"
+	"context"
 	"fmt"
-	"regexp"
-	"strings"
-
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 )
 
-/**
-	Known Issue:
-		If the command containes " && " , the hijack sometimes returns the first part command result ,
-		and rest part of commands result return to the next hijack .
-**/
-func (d *DockerClient) readerToString(reader *bufio.Reader) (string, error) {
-	header := make([]byte, 8) // [8]byte{STREAM_TYPE, 0, 0, 0, SIZE1, SIZE2, SIZE3, SIZE4}[]byte{OUTPUT}
-	_, err := reader.Read(header)
-	if err != nil {
-
-		return "", err
-	}
-	retType := int(header[0]) // 1 --stdout , 2 -- stderr
-	length := binary.BigEndian.Uint32(header[4:])
+// scriptDir is the directory of the scripts in the containers
+const scriptDir = "/tmp"
 
-	output := make([]byte, length)
-	if err != nil {
-		return "", err
-	}
+// Run runs the command with the Timeout
+func (d *DockerClient) Run(dir, command string, args ...string) (*util.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	return d.RunContext(ctx, &util.RunRequest{Dir: dir, Command: command, Args: args})
+}
 
-	_, err = reader.Read(output)
-	if err != nil {
-		return "", err
+// RunContext runs the request until it exits or the ctx is done. The stdin of the long-lived
+// shell is the stream of the commands, so a request with stdin is always run in its own exec.
+// A script is copied into the container first, and removed after the run.
+// Docker can't kill an exec, a cancelled command keeps running in the container until it exits.
+func (d *DockerClient) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	start := time.Now()
+	command, args := req.Command, req.Args
+	if req.Script != nil {
+		remote, err := d.copyScript(req.Script)
+		if err != nil {
+			return nil, err
+		}
+		defer d.runAction("rm", "-f", remote)
+		command, args = util.ScriptCommand(req.Interpreter, remote, args)
 	}
 
-	if retType == 2 {
-		return "", errors.New(string(output))
+	var result *util.Result
+	var err error
+	outputs := util.NewOutputs(req)
+	if d.ExecMode == ExecModePerCommand || req.Stdin != nil {
+		result, err = d.runExec(ctx, outputs, req.Stdin, req.Dir, command, args...)
 	} else {
-		return string(output), nil
+		result, err = d.runShell(ctx, outputs, req.Dir, command, args...)
 	}
-}
-
-//fixArgs , always add a echo '' to avoid the timeout issue , and make sure the args end with '\n'
-// https://github.com/moby/moby/issues/37182
-func fixArgs(command string, args ...string) (string, []string) {
-	command = "echo ` " + command
-	if len(args) == 0 {
-		args = append(args, " ` \n")
-	} else {
-		lastItem := args[len(args)-1]
-		m, _ := regexp.MatchString(".*\n *$", lastItem)
-		if m {
-			args = append(args[:len(args)-1])
-			args = append(args, lastItem[0:strings.LastIndex(lastItem, "\n")])
-
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("The command is killed: %v", ctx.Err())
 		}
-		args = append(args, " ` \n")
+		return nil, err
 	}
-	return command, args
-
+	result.Timings.Start = start
+	result.Timings.Total = time.Since(start)
+	return result, nil
 }
 
-
-func (d *DockerClient) Run(dir, command string, args ...string) (string, error) {
+// runShell writes the command into the long-lived shell and reads its output until the sentinel.
+func (d *DockerClient) runShell(ctx context.Context, outputs *util.Outputs, dir, command string, args ...string) (*util.Result, error) {
 	d.commandMutex.Lock()
 	defer d.commandMutex.Unlock()
-	command, args = fixArgs(command, args...)
 
+	d.connectTime = 0
 	err := d.Connect()
 	if err != nil {
 		fmt.Println("reconnect")
 		err = d.Reconnect() // always Reconnect if it's failed in first connect
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 	hijacked := d.hijackedResponse
 	if hijacked == nil {
 		err = fmt.Errorf("connection is closed  for %v ", d.name)
 		d.execErr = err
-		return "", err
+		return nil, err
 	}
 	if hijacked.Conn == nil || hijacked.Reader == nil {
 		err = fmt.Errorf("connection is closed  for %v ", d.name)
 		d.execErr = err
-		return "", err
+		return nil, err
+	}
+
+	sentinel, err := newSentinel()
+	if err != nil {
+		return nil, err
 	}
 
-	// fmt.Println(util.BuildCmd(dir, command, args...))
+	stop := watchContext(ctx, hijacked.Conn)
+	defer stop()
 
-	_, err = hijacked.Conn.Write([]byte(util.BuildCmd(dir, command, args...)))
+	execStart := time.Now()
+	_, err = hijacked.Conn.Write([]byte(sentinelCommand(util.BuildCmd(d.Shell, dir, command, args...), sentinel)))
 	if err != nil {
 		d.execErr = err
+		return nil, err
+	}
+
+	exitCode, err := readUntilSentinel(hijacked.Reader, sentinel, outputs)
+	if err != nil {
+		// the rest of the output would be read by the next command, so the shell is started again
+		d.Close()
+		d.execErr = err
+		return nil, err
+	}
+	result := &util.Result{
+		ExitCode: exitCode,
+		Timings:  util.Timings{Connect: d.connectTime, Exec: time.Since(execStart)},
+		Metadata: map[string]interface{}{"container": d.name},
+	}
+	setOutputs(result, outputs)
+	return result, nil
+}
+
+// watchContext sets the deadline of the ctx on the conn, and interrupts its reads and writes
+// once the ctx is done. stop must be called before the conn is used again.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// copyScript copies the script into the container and returns its path.
+func (d *DockerClient) copyScript(script []byte) (string, error) {
+	local, err := util.WriteTempScript(script)
+	if err != nil {
 		return "", err
 	}
-	hijacked.Conn.SetDeadline(time.Now().Add(d.Timeout))
+	defer os.Remove(local)
 
-	output, err := d.readerToString(hijacked.Reader)
-	d.execErr = err
-	return strings.Trim(string(output), "\n"), err
+	if err := d.copyFilesToContainer(local, scriptDir, "0700"); err != nil {
+		return "", fmt.Errorf("Failed to copy the script into the container: %v", err)
+	}
+	return path.Join(scriptDir, filepath.Base(local)), nil
 }
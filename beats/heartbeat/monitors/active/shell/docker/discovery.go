@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	dclient "github.com/docker/docker/client"
+)
+
+// discoveryAPI is the part of the docker client used by the Discovery
+type discoveryAPI interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Close() error
+}
+
+// Discovery keeps the running containers matching the Filter of an endpoint. The containers are
+// listed once, then the started and stopped containers are added and removed by the events of
+// the endpoint. They are listed again once the events are lost.
+type Discovery struct {
+	Endpoint string
+	Filter   []string
+	Timeout  time.Duration
+	// TLS and APIVersion are the settings of the endpoint like in the DockerClient
+	TLS        *tls.Config
+	APIVersion string
+
+	api        discoveryAPI
+	mutex      sync.Mutex
+	containers map[string]types.Container
+	watching   bool
+	cancel     context.CancelFunc
+}
+
+func NewDiscovery(endpoint string, filter []string, timeout time.Duration) *Discovery {
+	return &Discovery{Endpoint: endpoint, Filter: filter, Timeout: timeout}
+}
+
+// Containers returns the running containers matching the Filter, sorted by name
+func (d *Discovery) Containers() ([]types.Container, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.watching {
+		if err := d.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	containers := make([]types.Container, 0, len(d.containers))
+	for _, c := range d.containers {
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return ContainerName(containers[i]) < ContainerName(containers[j])
+	})
+	return containers, nil
+}
+
+// Close stops watching the events and closes the client of the endpoint, the next call of
+// Containers starts again.
+func (d *Discovery) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.cancel != nil {
+		d.cancel()
+		d.cancel = nil
+	}
+	d.watching = false
+	if d.api != nil {
+		d.api.Close()
+		d.api = nil
+	}
+}
+
+// start subscribes to the events before the containers are listed, no container can be missed
+// between them.
+func (d *Discovery) start() error {
+	if d.api == nil {
+		client, err := dclient.NewClient(d.Endpoint, d.APIVersion, newHTTPClient(d.TLS), nil)
+		if err != nil {
+			return err
+		}
+		if d.APIVersion == "" {
+			if err := negotiateVersion(client, d.Timeout); err != nil {
+				return err
+			}
+		}
+		d.api = client
+	}
+
+	filter := filters.NewArgs()
+	filter.Add("type", events.ContainerEventType)
+	for _, action := range []string{"start", "die", "destroy"} {
+		filter.Add("event", action)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, errs := d.api.Events(ctx, types.EventsOptions{Filters: filter})
+
+	containers, err := d.list(ctx, d.api, "")
+	if err != nil {
+		cancel()
+		return err
+	}
+	d.containers = map[string]types.Container{}
+	for _, c := range containers {
+		d.containers[c.ID] = c
+	}
+	d.watching = true
+	d.cancel = cancel
+	go d.watch(ctx, d.api, messages, errs)
+	return nil
+}
+
+// watch updates the containers until the events end, the next call of Containers lists them again
+func (d *Discovery) watch(ctx context.Context, api discoveryAPI, messages <-chan events.Message, errs <-chan error) {
+	for {
+		select {
+		case msg := <-messages:
+			d.handle(ctx, api, msg)
+		case <-errs:
+			d.mutex.Lock()
+			if ctx.Err() == nil {
+				d.watching = false
+				d.cancel()
+				d.cancel = nil
+			}
+			d.mutex.Unlock()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle adds a started container if it matches the Filter, and removes a stopped container.
+// The events of a cancelled watch are dropped, the containers may be listed again meanwhile.
+func (d *Discovery) handle(ctx context.Context, api discoveryAPI, msg events.Message) {
+	id := msg.Actor.ID
+	if id == "" {
+		id = msg.ID
+	}
+	if msg.Action != "start" {
+		d.mutex.Lock()
+		if ctx.Err() == nil {
+			delete(d.containers, id)
+		}
+		d.mutex.Unlock()
+		return
+	}
+
+	containers, err := d.list(ctx, api, id)
+	if err != nil || len(containers) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	if ctx.Err() == nil {
+		d.containers[id] = containers[0]
+	}
+	d.mutex.Unlock()
+}
+
+// list lists the running containers matching the Filter, only the container of a non empty id
+func (d *Discovery) list(ctx context.Context, api discoveryAPI, id string) ([]types.Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	filter := filterArgs(d.Filter)
+	if id != "" {
+		filter.Add("id", id)
+	}
+	return api.ContainerList(ctx, types.ContainerListOptions{Filters: filter})
+}
+
+// filterArgs converts the key:value filters of the config into the filters of the docker api
+func filterArgs(filter []string) filters.Args {
+	args := filters.NewArgs()
+	for _, value := range filter {
+		kv := strings.Split(value, ":")
+		if len(kv) == 2 {
+			args.Add(kv[0], kv[1])
+		}
+	}
+	return args
+}
+
+// ContainerName is the first name of the container without the leading /
+func ContainerName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
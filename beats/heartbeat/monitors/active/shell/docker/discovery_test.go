@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAPI lists the running containers by id, the label filter is a value of the labels
+type fakeAPI struct {
+	mutex      sync.Mutex
+	containers []types.Container
+	messages   chan events.Message
+	errs       chan error
+	subscribed int
+	closed     int
+}
+
+func newFakeAPI(containers ...types.Container) *fakeAPI {
+	return &fakeAPI{containers: containers}
+}
+
+func (f *fakeAPI) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var list []types.Container
+	for _, c := range f.containers {
+		ids := options.Filters.Get("id")
+		if len(ids) > 0 && ids[0] != c.ID {
+			continue
+		}
+		labels := options.Filters.Get("label")
+		if len(labels) > 0 && c.Labels["app"] != labels[0] {
+			continue
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func (f *fakeAPI) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.subscribed++
+	f.messages = make(chan events.Message)
+	f.errs = make(chan error, 1)
+	return f.messages, f.errs
+}
+
+func (f *fakeAPI) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed++
+	return nil
+}
+
+func (f *fakeAPI) start(c types.Container) {
+	f.mutex.Lock()
+	f.containers = append(f.containers, c)
+	messages := f.messages
+	f.mutex.Unlock()
+	messages <- events.Message{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: c.ID}}
+}
+
+func (f *fakeAPI) stop(id string) {
+	f.mutex.Lock()
+	for i, c := range f.containers {
+		if c.ID == id {
+			f.containers = append(f.containers[:i], f.containers[i+1:]...)
+			break
+		}
+	}
+	messages := f.messages
+	f.mutex.Unlock()
+	messages <- events.Message{Type: events.ContainerEventType, Action: "die", Actor: events.Actor{ID: id}}
+}
+
+func container(id, name, app string) types.Container {
+	return types.Container{ID: id, Names: []string{"/" + name}, Labels: map[string]string{"app": app}}
+}
+
+func containerNames(t *testing.T, d *Discovery) []string {
+	containers, err := d.Containers()
+	assert.NoError(t, err)
+	names := []string{}
+	for _, c := range containers {
+		names = append(names, ContainerName(c))
+	}
+	return names
+}
+
+func eventually(t *testing.T, want []string, d *Discovery) {
+	for i := 0; i < 100; i++ {
+		if assert.ObjectsAreEqual(want, containerNames(t, d)) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, want, containerNames(t, d))
+}
+
+func Test_discovery(t *testing.T) {
+	api := newFakeAPI(container("2", "web_2", "web"), container("1", "web_1", "web"), container("3", "db", "db"))
+	d := NewDiscovery("", []string{"label:web"}, time.Second)
+	d.api = api
+	defer d.Close()
+
+	assert.Equal(t, []string{"web_1", "web_2"}, containerNames(t, d))
+
+	api.start(container("4", "web_3", "web"))
+	api.start(container("5", "cache", "cache"))
+	eventually(t, []string{"web_1", "web_2", "web_3"}, d)
+
+	api.stop("1")
+	eventually(t, []string{"web_2", "web_3"}, d)
+	assert.Equal(t, 1, api.subscribed)
+
+	// the containers are listed again once the events are lost
+	api.errs <- errors.New("lost")
+	api.mutex.Lock()
+	api.containers = append(api.containers, container("6", "web_4", "web"))
+	api.mutex.Unlock()
+	eventually(t, []string{"web_2", "web_3", "web_4"}, d)
+	assert.Equal(t, 2, api.subscribed)
+}
+
+func Test_discovery_close(t *testing.T) {
+	api := newFakeAPI(container("1", "web_1", "web"))
+	d := NewDiscovery("", []string{"label:web"}, time.Second)
+	d.api = api
+	assert.Equal(t, []string{"web_1"}, containerNames(t, d))
+	d.Close()
+	assert.Equal(t, 1, api.closed)
+	assert.Nil(t, d.api)
+
+	// the events of the closed watch don't change the containers listed again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.api = api
+	defer d.Close()
+	assert.Equal(t, []string{"web_1"}, containerNames(t, d))
+	d.handle(ctx, api, events.Message{Action: "die", Actor: events.Actor{ID: "1"}})
+	api.mutex.Lock()
+	api.containers = append(api.containers, container("2", "web_2", "web"))
+	api.mutex.Unlock()
+	d.handle(ctx, api, events.Message{Action: "start", Actor: events.Actor{ID: "2"}})
+	assert.Equal(t, []string{"web_1"}, containerNames(t, d))
+}
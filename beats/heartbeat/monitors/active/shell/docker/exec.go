@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+const (
+	// ExecModeShell writes every command into a single long-lived shell
+	ExecModeShell = "shell"
+	// ExecModePerCommand creates a new exec for every command
+	ExecModePerCommand = "per_command"
+
+	execInspectInterval = 50 * time.Millisecond
+)
+
+// runExec runs the command in a new exec and waits for its exit code, the stdin is written
+// to the attached exec and closed.
+// The creation and the attach of the exec are the connect timing.
+func (d *DockerClient) runExec(ctx context.Context, outputs *util.Outputs, stdin io.Reader, dir, command string, args ...string) (*util.Result, error) {
+	start := time.Now()
+	if err := d.client(); err != nil {
+		return nil, err
+	}
+	container, err := d.getContainerBriefDetails(true)
+	if err != nil {
+		return nil, err
+	}
+	id := container.ID
+
+	d.actionMutex.RLock()
+	defer d.actionMutex.RUnlock()
+
+	resp, err := d.dockerClient.ContainerExecCreate(ctx, id, types.ExecConfig{
+		User:         d.User,
+		Env:          append(append([]string{}, d.Env...), util.EnvList(d.CommandEnv)...),
+		WorkingDir:   d.WorkingDir,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{execLinuxCommand, "-c", util.BuildCmd(d.Shell, dir, command, args...)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attachOutput, err := d.dockerClient.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{Detach: false, Tty: false})
+	if err != nil {
+		return nil, err
+	}
+	defer attachOutput.Close()
+	stop := watchContext(ctx, attachOutput.Conn)
+	defer stop()
+	execStart := time.Now()
+	connect := execStart.Sub(start)
+	if stdin != nil {
+		go func() {
+			// the command can exit without reading its stdin
+			io.Copy(attachOutput.Conn, stdin)
+			attachOutput.CloseWrite()
+		}()
+	}
+
+	if err := demux(attachOutput.Reader, outputs.StdoutWriter, outputs.Stderr); err != nil {
+		return nil, err
+	}
+
+	exitCode, err := d.waitExec(ctx, resp.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := &util.Result{
+		ExitCode: exitCode,
+		Timings:  util.Timings{Connect: connect, Exec: time.Since(execStart)},
+		Metadata: map[string]interface{}{"container": strings.Join(container.Names, " ")},
+	}
+	setOutputs(result, outputs)
+	return result, nil
+}
+
+// waitExec inspects the exec until it's stopped, the output can end before the exec is reported as stopped.
+func (d *DockerClient) waitExec(ctx context.Context, execID string) (int, error) {
+	for {
+		inspect, err := d.dockerClient.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(execInspectInterval):
+		}
+	}
+}
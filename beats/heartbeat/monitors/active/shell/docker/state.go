@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ContainerState is the state of the container reported by the docker api
+type ContainerState struct {
+	Name string
+	// Status is created, running, paused, restarting, removing, exited or dead
+	Status string
+	// Health is the HEALTHCHECK status starting, healthy or unhealthy, empty without HEALTHCHECK
+	Health        string
+	FailingStreak int
+	RestartCount  int
+	OOMKilled     bool
+	ExitCode      int
+	// Uptime is the time since the start of a running container
+	Uptime time.Duration
+}
+
+// ContainerState inspects the container, it works without exec and shell in the container.
+func (d *DockerClient) ContainerState() (*ContainerState, error) {
+	inspect, err := d.inspectContainer()
+	if err != nil {
+		return nil, err
+	}
+	return containerState(inspect, time.Now()), nil
+}
+
+func containerState(inspect types.ContainerJSON, now time.Time) *ContainerState {
+	state := &ContainerState{}
+	if inspect.ContainerJSONBase == nil {
+		return state
+	}
+	state.Name = strings.TrimPrefix(inspect.Name, "/")
+	state.RestartCount = inspect.RestartCount
+	if inspect.State == nil {
+		return state
+	}
+	state.Status = inspect.State.Status
+	state.OOMKilled = inspect.State.OOMKilled
+	state.ExitCode = inspect.State.ExitCode
+	if inspect.State.Health != nil {
+		state.Health = inspect.State.Health.Status
+		state.FailingStreak = inspect.State.Health.FailingStreak
+	}
+	if inspect.State.Running {
+		if started, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt); err == nil {
+			state.Uptime = now.Sub(started)
+		}
+	}
+	return state
+}
@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_container_state(t *testing.T) {
+	now := time.Date(2018, 11, 20, 10, 0, 0, 0, time.UTC)
+	inspect := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+		Name:         "/web_1",
+		RestartCount: 2,
+		State: &types.ContainerState{
+			Status:    "running",
+			Running:   true,
+			StartedAt: "2018-11-20T09:58:30.123456789Z",
+			Health:    &types.Health{Status: "unhealthy", FailingStreak: 4},
+		},
+	}}
+	state := containerState(inspect, now)
+	assert.Equal(t, &ContainerState{
+		Name:          "web_1",
+		Status:        "running",
+		Health:        "unhealthy",
+		FailingStreak: 4,
+		RestartCount:  2,
+		Uptime:        89*time.Second + 876543211*time.Nanosecond,
+	}, state)
+
+	// a stopped container has no uptime, and no health without HEALTHCHECK
+	inspect.State = &types.ContainerState{Status: "exited", ExitCode: 137, OOMKilled: true, StartedAt: "2018-11-20T09:58:30Z"}
+	state = containerState(inspect, now)
+	assert.Equal(t, &ContainerState{Name: "web_1", Status: "exited", RestartCount: 2, OOMKilled: true, ExitCode: 137}, state)
+}
@@ -0,0 +1,169 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+// The stream types of the multiplexed exec output, stdin is written to stdout.
+const (
+	stdinStream  = 0
+	stdoutStream = 1
+	stderrStream = 2
+
+	frameHeaderLen = 8 // [8]byte{STREAM_TYPE, 0, 0, 0, SIZE1, SIZE2, SIZE3, SIZE4}
+)
+
+// readHeader reads the header of the next frame. The payload size is sent by the remote end,
+// the payload is copied to its stream without allocating that size.
+func readHeader(reader io.Reader) (stream byte, size int64, err error) {
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, err
+	}
+
+	stream = header[0]
+	switch stream {
+	case stdinStream, stdoutStream, stderrStream:
+	default:
+		return stream, 0, fmt.Errorf("Unknown stream type %v in the exec output", stream)
+	}
+	return stream, int64(binary.BigEndian.Uint32(header[4:])), nil
+}
+
+// copyFrame reads one complete frame into stdout or stderr, the header and the payload can be split across reads.
+func copyFrame(reader io.Reader, stdout, stderr io.Writer) error {
+	stream, size, err := readHeader(reader)
+	if err != nil {
+		return err
+	}
+	w := stdout
+	if stream == stderrStream {
+		w = stderr
+	}
+	if _, err := io.CopyN(w, reader, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// demux copies the frames to stdout and stderr in the order they are received until the end of the stream.
+func demux(reader io.Reader, stdout, stderr io.Writer) error {
+	for {
+		err := copyFrame(reader, stdout, stderr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newSentinel returns a random marker which ends the output of a command in the shared shell.
+func newSentinel() (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return "__shell_monitor_" + hex.EncodeToString(nonce) + "__", nil
+}
+
+// sentinelCommand runs the command in a subshell without stdin, then writes the sentinel
+// followed by the exit code to stdout, and the sentinel alone to stderr.
+func sentinelCommand(command, sentinel string) string {
+	return fmt.Sprintf("( %v ) </dev/null; echo '%v' $?; echo '%v' >&2\n", command, sentinel, sentinel)
+}
+
+// readUntilSentinel demuxes the output of a command written with sentinelCommand into the outputs,
+// and returns the exit code. It returns when both streams end with the sentinel, or with an error
+// if the shell exits before.
+func readUntilSentinel(reader io.Reader, sentinel string, outputs *util.Outputs) (int, error) {
+	stdout := newSentinelWriter(outputs.StdoutWriter, sentinel)
+	stderr := newSentinelWriter(outputs.Stderr, sentinel)
+
+	for !stdout.done() || !stderr.done() {
+		err := copyFrame(reader, stdout, stderr)
+		if err == io.EOF {
+			return 0, fmt.Errorf("The shell exited before the command completed")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	line := string(stdout.line[len(sentinel):])
+	status := strings.TrimSpace(strings.SplitN(line, "\n", 2)[0])
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid exit code '%v' in the command output", status)
+	}
+	return code, nil
+}
+
+// setOutputs sets the outputs in the result without the newlines around them
+func setOutputs(result *util.Result, outputs *util.Outputs) {
+	outputs.SetResult(result)
+	result.Stdout = strings.Trim(result.Stdout, "\n")
+	result.Stderr = strings.Trim(result.Stderr, "\n")
+}
+
+// maxSentinelLine bounds the sentinel line, it's only followed by the exit code
+const maxSentinelLine = 256
+
+// sentinelWriter writes the output to w until the sentinel, and keeps the line of the sentinel.
+// The bytes which can be the start of the sentinel are held back until the next write.
+type sentinelWriter struct {
+	w        io.Writer
+	sentinel []byte
+	pending  []byte
+	line     []byte
+}
+
+func newSentinelWriter(w io.Writer, sentinel string) *sentinelWriter {
+	return &sentinelWriter{w: w, sentinel: []byte(sentinel)}
+}
+
+func (s *sentinelWriter) Write(p []byte) (int, error) {
+	if s.line != nil {
+		if len(s.line)+len(p) > maxSentinelLine {
+			return 0, fmt.Errorf("Invalid sentinel line in the command output")
+		}
+		s.line = append(s.line, p...)
+		return len(p), nil
+	}
+
+	s.pending = append(s.pending, p...)
+	if pos := bytes.Index(s.pending, s.sentinel); pos >= 0 {
+		s.line = append([]byte{}, s.pending[pos:]...)
+		_, err := s.w.Write(s.pending[:pos])
+		s.pending = nil
+		return len(p), err
+	}
+	keep := len(s.sentinel) - 1
+	if len(s.pending) <= keep {
+		return len(p), nil
+	}
+	n := len(s.pending) - keep
+	if _, err := s.w.Write(s.pending[:n]); err != nil {
+		return 0, err
+	}
+	s.pending = append(s.pending[:0], s.pending[n:]...)
+	return len(p), nil
+}
+
+// done checks if the sentinel and the rest of its line have been received
+func (s *sentinelWriter) done() bool {
+	return bytes.IndexByte(s.line, '\n') >= 0
+}
@@ -0,0 +1,127 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+const testSentinel = "__shell_monitor_0123456789abcdef__"
+
+func muxFrame(stream byte, data string) []byte {
+	header := make([]byte, frameHeaderLen)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func muxStream(frames ...[]byte) []byte {
+	var stream []byte
+	for _, f := range frames {
+		stream = append(stream, f...)
+	}
+	return stream
+}
+
+func Test_demux(t *testing.T) {
+	// recorded from `sh -c 'echo a; echo b >&2; echo c'`
+	recorded := []byte("\x01\x00\x00\x00\x00\x00\x00\x02a\n\x02\x00\x00\x00\x00\x00\x00\x02b\n\x01\x00\x00\x00\x00\x00\x00\x02c\n")
+
+	for name, reader := range map[string]io.Reader{
+		"full":     bytes.NewReader(recorded),
+		"one byte": iotest.OneByteReader(bytes.NewReader(recorded)),
+		"half":     iotest.HalfReader(bytes.NewReader(recorded)),
+	} {
+		var stdout, stderr bytes.Buffer
+		err := demux(reader, &stdout, &stderr)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "a\nc\n", stdout.String(), name)
+		assert.Equal(t, "b\n", stderr.String(), name)
+	}
+}
+
+func Test_demux_truncated(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := demux(bytes.NewReader(muxFrame(stdoutStream, "hello")[:10]), &stdout, &stderr)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	err = demux(bytes.NewReader([]byte("\x05\x00\x00\x00\x00\x00\x00\x01x")), &stdout, &stderr)
+	assert.Error(t, err)
+
+	// the size of the header isn't allocated
+	err = demux(bytes.NewReader([]byte("\x01\x00\x00\x00\xff\xff\xff\xffx")), &stdout, &stderr)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func Test_read_until_sentinel(t *testing.T) {
+	stream := muxStream(
+		muxFrame(stdoutStream, "first && "),
+		muxFrame(stderrStream, "warn\n"),
+		muxFrame(stdoutStream, "second\n__shell_monitor_01234"),
+		muxFrame(stdoutStream, "56789abcdef__ 3"),
+		muxFrame(stdoutStream, "\n"),
+		muxFrame(stderrStream, testSentinel+"\n"),
+		// the output of the next command must not be read
+		muxFrame(stdoutStream, "next\n"),
+	)
+
+	reader := iotest.OneByteReader(bytes.NewReader(stream))
+	outputs := util.NewOutputs(&util.RunRequest{})
+	code, err := readUntilSentinel(reader, testSentinel, outputs)
+	if assert.NoError(t, err) {
+		result := &util.Result{ExitCode: code}
+		setOutputs(result, outputs)
+		assert.Equal(t, "first && second", result.Stdout)
+		assert.Equal(t, "warn", result.Stderr)
+		assert.Equal(t, 3, result.ExitCode)
+	}
+
+	var next bytes.Buffer
+	assert.NoError(t, copyFrame(reader, &next, &next))
+	assert.Equal(t, "next\n", next.String())
+}
+
+func Test_read_until_sentinel_truncated(t *testing.T) {
+	stream := muxStream(
+		muxFrame(stdoutStream, strings.Repeat("0123456789", 1000)+"\n"),
+		muxFrame(stdoutStream, testSentinel+" 0\n"),
+		muxFrame(stderrStream, testSentinel+"\n"),
+	)
+
+	var whole bytes.Buffer
+	outputs := util.NewOutputs(&util.RunRequest{MaxBytes: 20, Output: &whole})
+	code, err := readUntilSentinel(bytes.NewReader(stream), testSentinel, outputs)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+
+	result := &util.Result{}
+	setOutputs(result, outputs)
+	assert.True(t, result.Truncated)
+	assert.Equal(t, int64(10001), result.StdoutBytes)
+	assert.Equal(t, "0123456789\n... 9981 bytes truncated ...\n123456789", result.Stdout)
+	assert.Equal(t, strings.Repeat("0123456789", 1000)+"\n", whole.String())
+}
+
+func Test_read_until_sentinel_exit(t *testing.T) {
+	stream := muxStream(muxFrame(stdoutStream, "partial"))
+
+	_, err := readUntilSentinel(bytes.NewReader(stream), testSentinel, util.NewOutputs(&util.RunRequest{}))
+	assert.EqualError(t, err, "The shell exited before the command completed")
+}
+
+func Test_sentinel_command(t *testing.T) {
+	sentinel, err := newSentinel()
+	assert.NoError(t, err)
+	assert.Len(t, sentinel, len(testSentinel))
+
+	assert.Equal(t,
+		"( cd /tmp && ls  ) </dev/null; echo '"+testSentinel+"' $?; echo '"+testSentinel+"' >&2\n",
+		sentinelCommand("cd /tmp && ls ", testSentinel))
+}
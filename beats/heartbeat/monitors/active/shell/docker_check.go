@@ -0,0 +1,112 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/heartbeat/look"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/heartbeat/reason"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// containerStater is a client reporting the state of its container
+type containerStater interface {
+	ContainerState() (*docker.ContainerState, error)
+}
+
+// runDockerCheck checks the state of the container without exec, then runs the request in the
+// running container if it has a command or script.
+func runDockerCheck(ctx context.Context, comm shellComm, check *checkConfig, req *util.RunRequest, validate ResultCheck, nagios *nagiosScanner) (common.MapStr, reason.Reason) {
+	start := time.Now()
+	stater, ok := comm.(containerStater)
+	if !ok {
+		return nil, reason.IOFailed(fmt.Errorf("The check.docker settings require docker"))
+	}
+	state, err := stater.ContainerState()
+	if err != nil {
+		if sshErr := sshFailure(err); sshErr != nil {
+			return nil, sshErr
+		}
+		return nil, reason.IOFailed(err)
+	}
+
+	err = checkContainerState(check.Docker, state)
+	if err != nil || (req.Command == "" && req.Script == nil) {
+		event := common.MapStr{"shell": common.MapStr{
+			"docker": dockerStateEvent(state),
+			"rtt":    common.MapStr{"total": look.RTT(time.Since(start))},
+		}}
+		if err != nil {
+			return event, reason.ValidateFailed(err)
+		}
+		return event, nil
+	}
+
+	_, _, event, errReason := runCommand(ctx, comm, check, req, validate, nagios)
+	event.Put("shell.docker", dockerStateEvent(state))
+	return event, errReason
+}
+
+// checkContainerState fails on the first setting the container doesn't satisfy
+func checkContainerState(config *dockerCheckConfig, state *docker.ContainerState) error {
+	states := config.State
+	if len(states) == 0 {
+		states = []string{"running"}
+	}
+	if !contains(states, state.Status) {
+		return fmt.Errorf("The container is %v", state.Status)
+	}
+
+	health := state.Health
+	if health == "" {
+		health = "none"
+	}
+	accepted := health != "unhealthy"
+	if len(config.Health) != 0 {
+		accepted = contains(config.Health, health)
+	}
+	if !accepted {
+		return fmt.Errorf("The container health is %v after %v failing checks", health, state.FailingStreak)
+	}
+
+	if config.MaxRestarts != nil && state.RestartCount > *config.MaxRestarts {
+		return fmt.Errorf("The container restarted %v times", state.RestartCount)
+	}
+	if config.FailOnOOMKilled && state.OOMKilled {
+		return fmt.Errorf("The container is OOM killed")
+	}
+	if state.Status == "running" && state.Uptime < config.MinUptime {
+		return fmt.Errorf("The container is up since %v only", state.Uptime.Round(time.Second))
+	}
+	return nil
+}
+
+func dockerStateEvent(state *docker.ContainerState) common.MapStr {
+	event := common.MapStr{
+		"name":          state.Name,
+		"state":         state.Status,
+		"restart_count": state.RestartCount,
+		"oom_killed":    state.OOMKilled,
+		"exit_code":     state.ExitCode,
+		"uptime":        look.RTT(state.Uptime),
+	}
+	if state.Health != "" {
+		event["health"] = common.MapStr{
+			"status":         state.Health,
+			"failing_streak": state.FailingStreak,
+		}
+	}
+	return event
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
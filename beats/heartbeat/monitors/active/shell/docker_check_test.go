@@ -0,0 +1,103 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/ssh"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+// fakeContainer reports the state without docker and records the runs
+type fakeContainer struct {
+	state *docker.ContainerState
+	err   error
+	runs  int
+}
+
+func (f *fakeContainer) ContainerState() (*docker.ContainerState, error) {
+	return f.state, f.err
+}
+
+func (f *fakeContainer) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	f.runs++
+	return &util.Result{Stdout: "ok"}, nil
+}
+
+func Test_check_container_state(t *testing.T) {
+	zero := 0
+	running := docker.ContainerState{Status: "running", Health: "healthy", Uptime: time.Minute}
+	cases := []struct {
+		config dockerCheckConfig
+		modify func(s *docker.ContainerState)
+		err    string
+	}{
+		{dockerCheckConfig{}, func(s *docker.ContainerState) {}, ""},
+		{dockerCheckConfig{}, func(s *docker.ContainerState) { s.Status = "exited" }, "The container is exited"},
+		{dockerCheckConfig{State: []string{"exited"}}, func(s *docker.ContainerState) { s.Status = "exited" }, ""},
+		{dockerCheckConfig{}, func(s *docker.ContainerState) { s.Health = "starting" }, ""},
+		{dockerCheckConfig{}, func(s *docker.ContainerState) { s.Health = "unhealthy"; s.FailingStreak = 3 }, "The container health is unhealthy after 3 failing checks"},
+		{dockerCheckConfig{Health: []string{"healthy"}}, func(s *docker.ContainerState) { s.Health = "starting" }, "The container health is starting after 0 failing checks"},
+		{dockerCheckConfig{Health: []string{"none"}}, func(s *docker.ContainerState) { s.Health = "" }, ""},
+		{dockerCheckConfig{}, func(s *docker.ContainerState) { s.RestartCount = 5 }, ""},
+		{dockerCheckConfig{MaxRestarts: &zero}, func(s *docker.ContainerState) { s.RestartCount = 1 }, "The container restarted 1 times"},
+		{dockerCheckConfig{}, func(s *docker.ContainerState) { s.OOMKilled = true }, ""},
+		{dockerCheckConfig{FailOnOOMKilled: true}, func(s *docker.ContainerState) { s.OOMKilled = true }, "The container is OOM killed"},
+		{dockerCheckConfig{MinUptime: 5 * time.Minute}, func(s *docker.ContainerState) {}, "The container is up since 1m0s only"},
+	}
+	for i, c := range cases {
+		state := running
+		c.modify(&state)
+		err := checkContainerState(&c.config, &state)
+		if c.err == "" {
+			assert.NoError(t, err, "case %v", i)
+		} else {
+			assert.EqualError(t, err, c.err, "case %v", i)
+		}
+	}
+}
+
+func Test_run_docker_check(t *testing.T) {
+	check := &checkConfig{Docker: &dockerCheckConfig{}}
+	validate := func(*util.Result) error { return nil }
+
+	// without command the state is checked alone
+	container := &fakeContainer{state: &docker.ContainerState{Status: "running", Name: "web"}}
+	event, err := runDockerCheck(context.Background(), container, check, &util.RunRequest{}, validate, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, container.runs)
+	state, _ := event.GetValue("shell.docker.state")
+	assert.Equal(t, "running", state)
+
+	event, err = runDockerCheck(context.Background(), container, check, &util.RunRequest{Command: "true"}, validate, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, container.runs)
+	stdout, _ := event.GetValue("shell.response.stdout")
+	assert.Equal(t, "ok", stdout)
+
+	// the command isn't run in a stopped container
+	container = &fakeContainer{state: &docker.ContainerState{Status: "exited", ExitCode: 137}}
+	event, err = runDockerCheck(context.Background(), container, check, &util.RunRequest{Command: "true"}, validate, nil)
+	assert.EqualError(t, err, "The container is exited")
+	assert.Equal(t, "validate", err.Type())
+	assert.Equal(t, 0, container.runs)
+	code, _ := event.GetValue("shell.docker.exit_code")
+	assert.Equal(t, 137, code)
+
+	container = &fakeContainer{err: errors.New("No such container")}
+	_, err = runDockerCheck(context.Background(), container, check, &util.RunRequest{}, validate, nil)
+	assert.Equal(t, "io", err.Type())
+
+	// the ssh failures of a forwarded socket keep their reason
+	container = &fakeContainer{err: &ssh.HostKeyError{Host: "docker.example.com"}}
+	_, err = runDockerCheck(context.Background(), container, check, &util.RunRequest{}, validate, nil)
+	assert.Equal(t, "host_key", err.Type())
+	container = &fakeContainer{err: &ssh.CertificateError{KeyID: "monitor", Expired: true}}
+	_, err = runDockerCheck(context.Background(), container, check, &util.RunRequest{}, validate, nil)
+	assert.Equal(t, "certificate", err.Type())
+}
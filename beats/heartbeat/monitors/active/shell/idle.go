@@ -0,0 +1,84 @@
+package shell
+
+import (
+	"sync"
+	"time"
+)
+
+// idleCloser opens the clients of a job for its runs, and closes them once no run used them for
+// the idle timeout. Heartbeat doesn't close the jobs of a stopped or reloaded monitor, the docker
+// clients and the sockets forwarded through ssh are released this way.
+type idleCloser struct {
+	idle time.Duration
+	open func() (close func(), err error)
+
+	mutex sync.Mutex
+	close func()
+	uses  int
+	timer *time.Timer
+}
+
+// openIdle opens the clients at once, their errors are reported when the monitor is created.
+// They are closed after the idle timeout if the job never runs.
+func openIdle(idle time.Duration, open func() (close func(), err error)) (*idleCloser, error) {
+	c := &idleCloser{idle: idle, open: open}
+	done, err := c.use()
+	if err != nil {
+		return nil, err
+	}
+	done()
+	return c, nil
+}
+
+// use opens the clients again if they were closed, done must be called once the run is over
+func (c *idleCloser) use() (done func(), err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.close == nil {
+		close, err := c.open()
+		if err != nil {
+			return nil, err
+		}
+		c.close = close
+	}
+	return c.add(), nil
+}
+
+// retain adds a use of the clients by a caller already using them, like the continuation tasks
+// of a run
+func (c *idleCloser) retain() (done func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.add()
+}
+
+func (c *idleCloser) add() func() {
+	c.uses++
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	var once sync.Once
+	return func() { once.Do(c.release) }
+}
+
+func (c *idleCloser) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.uses--
+	if c.uses == 0 {
+		c.timer = time.AfterFunc(c.idle, c.closeIdle)
+	}
+}
+
+// closeIdle closes the clients unless they are used again, a stopped timer may still fire
+func (c *idleCloser) closeIdle() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.uses > 0 || c.close == nil {
+		return
+	}
+	c.close()
+	c.close = nil
+	c.timer = nil
+}
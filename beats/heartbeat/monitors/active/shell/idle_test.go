@@ -0,0 +1,55 @@
+package shell
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_idle_closer(t *testing.T) {
+	var mutex sync.Mutex
+	opened, closed := 0, 0
+	count := func(n *int) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return *n
+	}
+	closer, err := openIdle(50*time.Millisecond, func() (func(), error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		opened++
+		return func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			closed++
+		}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count(&opened))
+
+	// the clients are kept while they're used, and closed once they're idle
+	done, err := closer.use()
+	assert.NoError(t, err)
+	task := closer.retain()
+	done()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, count(&closed))
+	task()
+	task()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, count(&closed))
+
+	// the next run opens them again
+	done, err = closer.use()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count(&opened))
+	done()
+
+	_, err = openIdle(time.Second, func() (func(), error) {
+		return nil, errors.New("refused")
+	})
+	assert.Error(t, err)
+}
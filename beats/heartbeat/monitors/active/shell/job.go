@@ -1,33 +1,37 @@
 package shell
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/elastic/beats/heartbeat/monitors/active/shell/docker"
 	"github.com/elastic/beats/heartbeat/monitors/active/shell/local"
 	"github.com/elastic/beats/heartbeat/monitors/active/shell/ssh"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 
+	"github.com/elastic/beats/heartbeat/look"
 	"github.com/elastic/beats/heartbeat/monitors"
 	"github.com/elastic/beats/heartbeat/reason"
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/libbeat/logp"
 )
 
 type shellComm interface {
-	Run(dir, command string, args ...string) (string, error)
+	RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error)
 }
 
+// createClinet creates the local or ssh client of the host, the docker clients are created by
+// the dockerAPI of the endpoint.
 func createClinet(addr string, config *Config) (Client, error) {
 	// fmt.Println(addr)
-	if config.Docker {
-		docker := docker.NewDockerClient()
-		docker.Endpoint = addr
-		docker.Timeout = config.Timeout
-		docker.Filter = config.Dockerfilter
-		return docker, nil
-	}
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -35,27 +39,204 @@ func createClinet(addr string, config *Config) (Client, error) {
 	if strings.ToLower(host) == "localhost" {
 		lclient := local.NewLocalClient()
 		lclient.Timeout = config.Timeout
+		lclient.Shell = config.Check.Request.shell(false)
+		lclient.Env = config.Check.Request.Env
+		lclient.RunAs = config.Local.RunAs
+		lclient.Sandbox = config.Local.Sandbox
+		lclient.Limits = local.Limits{
+			CPU:       config.Local.Limits.CPU,
+			Memory:    int64(config.Local.Limits.Memory),
+			OpenFiles: config.Local.Limits.OpenFiles,
+			Processes: config.Local.Limits.Processes,
+		}
 		return lclient, nil
 	}
+	return createSSHClient(addr, config.Username, config), nil
+}
+
+func createSSHClient(addr, username string, config *Config) *ssh.SSHClient {
+	sshClient := newSSHClient(addr, username, config.Password, config.Key, config.Certificate, &config.SSH, config.Timeout)
+	sshClient.Shell = config.Check.Request.shell(true)
+	sshClient.Env = config.Check.Request.Env
+	for _, hop := range config.ProxyJump {
+		jump := newSSHClient(hop.Host, hop.Username, hop.Password, hop.Key, hop.Certificate, &hop.SSH, config.Timeout)
+		sshClient.ProxyJump = append(sshClient.ProxyJump, jump)
+	}
+	return sshClient
+}
+
+func createDockerClient(addr string, config *Config, tlsConfig *tls.Config) *docker.DockerClient {
+	docker := docker.NewDockerClient()
+	docker.Endpoint = addr
+	docker.TLS = tlsConfig
+	docker.APIVersion = config.Docker.APIVersion
+	docker.Timeout = config.Timeout
+	docker.Filter = config.Dockerfilter
+	docker.ExecMode = config.Docker.Exec.Mode
+	docker.User = config.Docker.Exec.User
+	docker.Env = config.Docker.Exec.Env
+	docker.WorkingDir = config.Docker.Exec.WorkingDir
+	docker.Shell = config.Check.Request.shell(true)
+	docker.CommandEnv = config.Check.Request.Env
+	return docker
+}
+
+// dockerAPI is the docker api of a host, an ssh:// endpoint is served by a local socket forwarded
+// to the docker socket of the host through the ssh settings.
+type dockerAPI struct {
+	endpoint string
+	tls      *tls.Config
+	// forward is the forwarded socket of an ssh:// endpoint, nil for the other endpoints
+	forward *ssh.SocketForward
+}
+
+func openDockerAPI(addr string, config *Config) (*dockerAPI, error) {
+	if !strings.HasPrefix(addr, sshEndpointPrefix) {
+		tlsConfig, err := dockerTLS(addr, config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		return &dockerAPI{endpoint: addr, tls: tlsConfig}, nil
+	}
+	host, username, socket, err := parseSSHEndpoint(addr, config.Username)
+	if err != nil {
+		return nil, err
+	}
+	forward, err := createSSHClient(host, username, config).ForwardSocket(socket)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerAPI{endpoint: "unix://" + forward.Path(), forward: forward}, nil
+}
+
+// client creates a docker client of the api
+func (a *dockerAPI) client(config *Config) *docker.DockerClient {
+	return createDockerClient(a.endpoint, config, a.tls)
+}
+
+// comm is the client run by the checks, the ssh failures of a forwarded socket are reported
+// instead of the closed socket seen by the docker api.
+func (a *dockerAPI) comm(client *docker.DockerClient) shellComm {
+	if a.forward == nil {
+		return client
+	}
+	return &forwardedClient{DockerClient: client, api: a}
+}
+
+// err replaces the error of the docker api by the failure of the ssh connection, if any
+func (a *dockerAPI) err(err error) error {
+	if err == nil || a.forward == nil {
+		return err
+	}
+	if sshErr := a.forward.Err(); sshErr != nil {
+		return sshErr
+	}
+	return err
+}
+
+// Close releases the forwarded socket
+func (a *dockerAPI) Close() {
+	if a.forward != nil {
+		a.forward.Close()
+	}
+}
+
+// forwardedClient is a docker client on a socket forwarded through ssh
+type forwardedClient struct {
+	*docker.DockerClient
+	api *dockerAPI
+}
+
+func (c *forwardedClient) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	result, err := c.DockerClient.RunContext(ctx, req)
+	return result, c.api.err(err)
+}
+
+func (c *forwardedClient) ContainerState() (*docker.ContainerState, error) {
+	state, err := c.DockerClient.ContainerState()
+	return state, c.api.err(err)
+}
+
+// parseSSHEndpoint splits ssh://user@host:port/path/to/docker.sock, the username of the config,
+// the port 22 and the default docker socket are used without them.
+func parseSSHEndpoint(addr, defaultUsername string) (host, username, socket string, err error) {
+	endpoint, err := url.Parse(addr)
+	if err != nil {
+		return "", "", "", err
+	}
+	if endpoint.Hostname() == "" {
+		return "", "", "", fmt.Errorf("The docker endpoint %v has no host", addr)
+	}
+	host = endpoint.Host
+	if endpoint.Port() == "" {
+		host = net.JoinHostPort(endpoint.Hostname(), "22")
+	}
+	username = defaultUsername
+	if endpoint.User != nil {
+		username = endpoint.User.Username()
+	}
+	socket = endpoint.Path
+	if socket == "" || socket == "/" {
+		socket = defaultDockerSocket
+	}
+	return host, username, socket, nil
+}
+
+// dockerTLS is the client config of the docker endpoint by the ssl settings, nil if they aren't
+// enabled. The certificate of the daemon is verified against the host of the endpoint.
+func dockerTLS(addr string, config *tlscommon.Config) (*tls.Config, error) {
+	tlsConfig, err := tlscommon.LoadTLSConfig(config)
+	if err != nil || tlsConfig == nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig.BuildModuleConfig(endpoint.Hostname()), nil
+}
+
+func newSSHClient(addr, username, password, key, certificate string, config *sshConfig, timeout time.Duration) *ssh.SSHClient {
 	sshClient := ssh.NewSSHClient()
 	sshClient.Addr = addr
-	sshClient.Username = config.Username
-	sshClient.Password = config.Password
-	sshClient.Timeout = config.Timeout
-	sshClient.Key = config.Key
-	return sshClient, nil
+	sshClient.Username = username
+	sshClient.Password = password
+	sshClient.Timeout = timeout
+	sshClient.Key = key
+	sshClient.Certificate = certificate
+	sshClient.Auth = config.Auth
+	sshClient.HostKeyPolicy = config.HostKeyPolicy
+	if config.HostKeyPolicy == ssh.HostKeyInsecure {
+		logp.Warn("The host key of %s isn't verified, host_key_policy is insecure", addr)
+	}
+	sshClient.KnownHosts = config.KnownHosts
+	sshClient.TOFUStateFile = config.TOFUStateFile
+	sshClient.HostCAKeys = config.HostCAKeys
+	sshClient.MaxSessions = config.Pool.MaxSessions
+	sshClient.IdleTimeout = config.Pool.IdleTimeout
+	sshClient.KeepaliveInterval = config.Keepalive.Interval
+	sshClient.KeepaliveMaxMissed = config.Keepalive.MaxMissed
+	sshClient.HostKeyFingerprints = map[string][]string{}
+	for _, pin := range config.HostKeyFingerprints {
+		sshClient.HostKeyFingerprints[pin.Host] = append(sshClient.HostKeyFingerprints[pin.Host], pin.Fingerprint)
+	}
+	return sshClient
 }
 
 func newShellMonitorJob(
 	addr string,
 	config *Config,
-	validator OutputCheck,
+	validator RunCheck,
 ) (monitors.Job, error) {
 
 	typ := config.Name
 	jobName := fmt.Sprintf("%v@%v", typ, addr)
 
-	cmd, err := createClinet(addr, config)
+	script, err := loadFile(config.Check.Request.Script)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := loadFile(config.Check.Request.Stdin)
 	if err != nil {
 		return nil, err
 	}
@@ -76,13 +257,26 @@ func newShellMonitorJob(
 			"args":     strings.Join(config.Check.Request.Args, " "),
 			"dir":      config.Check.Request.Dir,
 			"username": config.Username,
-			"docker":   config.Docker,
+			"docker":   config.Docker.Enabled,
 		},
 		"check": common.MapStr{
 			"ok":       okstr,
 			"critical": criticalStr,
 		},
 	}
+	if script != nil {
+		eventFields.Put("shell.script", common.MapStr{
+			"sha256":      util.ScriptHash(script),
+			"interpreter": config.Check.Request.Interpreter,
+		})
+	}
+	exitCodes := config.Check.ExitCode
+	if len(exitCodes.Ok) != 0 || len(exitCodes.Critical) != 0 {
+		eventFields.Put("check.exit_code", common.MapStr{
+			"ok":       strings.Join(exitCodes.Ok, ","),
+			"critical": strings.Join(exitCodes.Critical, ","),
+		})
+	}
 
 	customs := config.CustomeFields
 	if len(customs) != 0 {
@@ -100,29 +294,187 @@ func newShellMonitorJob(
 
 	settings := monitors.MakeJobSetting(jobName).WithFields(eventFields)
 
+	run := makeRun(config, script, stdin, validator)
+	if config.Docker.Enabled {
+		if config.Docker.Discovery {
+			return newDiscoveryJob(settings, addr, config, run)
+		}
+		var cmd shellComm
+		clients, err := openIdle(config.Docker.IdleTimeout, func() (func(), error) {
+			api, err := openDockerAPI(addr, config)
+			if err != nil {
+				return nil, err
+			}
+			client := api.client(config)
+			cmd = api.comm(client)
+			return func() {
+				client.Close()
+				api.Close()
+			}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return monitors.MakeSimpleJob(settings, func() (common.MapStr, error) {
+			done, err := clients.use()
+			if err != nil {
+				return nil, err
+			}
+			defer done()
+			return run(cmd)
+		}), nil
+	}
+
+	cmd, err := createClinet(addr, config)
+	if err != nil {
+		return nil, err
+	}
 	return monitors.MakeSimpleJob(settings, func() (common.MapStr, error) {
+		return run(cmd)
+	}), nil
+}
+
+// makeRun runs the check with a client, each run is cancelled once the timeout expires.
+// Heartbeat doesn't stop the jobs, a running check outlives its stopped monitor until the timeout.
+func makeRun(config *Config, script, stdin []byte, validator RunCheck) func(cmd shellComm) (common.MapStr, error) {
+	return func(cmd shellComm) (common.MapStr, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		defer cancel()
 
-		_, _, event, err := runCommand(cmd, config.Check.Request.Dir, config.Check.Request.Command, validator, config.Check.Request.Args...)
+		req := makeRequest(&config.Check.Request, script, stdin)
+		req.MaxBytes = int(config.Check.Response.MaxBytes)
+		validate := validator(req)
+		// the nagios output is scanned while it's read, it may be truncated
+		var nagios *nagiosScanner
+		if config.Check.Mode == nagiosMode && req.MaxBytes > 0 {
+			nagios = newNagiosScanner(req.MaxBytes)
+			addOutput(req, nagios)
+		}
+		if config.Check.Docker != nil {
+			event, err := runDockerCheck(ctx, cmd, &config.Check, req, validate, nagios)
+			return event, err
+		}
+		_, _, event, err := runCommand(ctx, cmd, &config.Check, req, validate, nagios)
 		return event, err
-	}), nil
+	}
+}
+
+// loadFile returns the inline value or the content of the @file, nil without value
+func loadFile(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if strings.Index(value, "@") == 0 {
+		return ioutil.ReadFile(value[1:])
+	}
+	return []byte(value), nil
 }
 
-func runCommand(comm shellComm, dir, command string, validate func(string) error, args ...string) (start, end time.Time, event common.MapStr, errReason reason.Reason) {
+// makeRequest builds the request of a run, the stdin is read by each run from the start
+func makeRequest(request *commandConfig, script, stdin []byte) *util.RunRequest {
+	req := &util.RunRequest{
+		Dir:         request.Dir,
+		Command:     request.Command,
+		Args:        request.Args,
+		Script:      script,
+		Interpreter: request.Interpreter,
+	}
+	if stdin != nil {
+		req.Stdin = bytes.NewReader(stdin)
+	}
+	return req
+}
+
+func runCommand(ctx context.Context, comm shellComm, check *checkConfig, req *util.RunRequest, validate ResultCheck, nagios *nagiosScanner) (start, end time.Time, event common.MapStr, errReason reason.Reason) {
 	start = time.Now()
-	output, err := comm.Run(dir, command, args...)
+	result, err := comm.RunContext(ctx, req)
 	end = time.Now()
-	event = makeEvent(output)
+	event = makeEvent(check, result, nagios)
+	event.Put("shell.rtt", makeRTT(result, end.Sub(start)))
+	switch err.(type) {
+	case *ssh.HostKeyError, *ssh.CertificateError:
+		errReason = sshFailure(err)
+		return
+	}
 	if err == nil {
-		err = validate(output)
+		err = validate(result)
 	}
 	errReason = reason.ValidateFailed(err)
 	return
 }
 
-func makeEvent(output string) common.MapStr {
-	return common.MapStr{"shell": common.MapStr{
-		"response": common.MapStr{
-			"output": output,
-		},
+// sshReason reports the ssh host key and certificate failures apart from the validation errors
+type sshReason struct {
+	typ string
+	err error
+}
+
+func sshFailed(typ string, err error) reason.Reason {
+	return sshReason{typ, err}
+}
+
+// sshFailure is the reason of the ssh host key and certificate failures, nil for the other errors
+func sshFailure(err error) reason.Reason {
+	switch err.(type) {
+	case *ssh.HostKeyError:
+		return sshFailed("host_key", err)
+	case *ssh.CertificateError:
+		return sshFailed("certificate", err)
+	}
+	return nil
+}
+
+func (r sshReason) Error() string { return r.err.Error() }
+func (r sshReason) Type() string  { return r.typ }
+
+// makeRTT reports the timings of the run by phase like the tcp.rtt and http.rtt of the other monitors,
+// only the total is known without result.
+func makeRTT(result *util.Result, total time.Duration) common.MapStr {
+	if result == nil {
+		return common.MapStr{"total": look.RTT(total)}
+	}
+	timings := result.Timings
+	if timings.Total > 0 {
+		total = timings.Total
+	}
+	return common.MapStr{
+		"connect":   look.RTT(timings.Connect),
+		"handshake": look.RTT(timings.Handshake),
+		"exec":      look.RTT(timings.Exec),
+		"total":     look.RTT(total),
+	}
+}
+
+// makeEvent reports the result, the nagios scanner is nil unless the output of a nagios plugin
+// is limited by the max bytes
+func makeEvent(check *checkConfig, result *util.Result, nagios *nagiosScanner) common.MapStr {
+	// output is the stdout like before the outputs were split, it's kept for the existing queries
+	response := common.MapStr{
+		"output": "",
+		"stdout": "",
+		"stderr": "",
+	}
+	if result != nil {
+		response["output"] = result.Stdout
+		response["stdout"] = result.Stdout
+		response["stderr"] = result.Stderr
+		response["exit_code"] = result.ExitCode
+		if result.Truncated {
+			response["truncated"] = true
+			response["stdout_bytes"] = result.StdoutBytes
+			response["stderr_bytes"] = result.StderrBytes
+		}
+		if check.Response.JSON != nil && !stdoutTruncated(result, int(check.Response.MaxBytes)) {
+			if doc, err := decodeJSON(result.Stdout); err == nil {
+				response["json"] = doc
+			}
+		}
+	}
+	event := common.MapStr{"shell": common.MapStr{
+		"response": response,
 	}}
+	if result != nil && check.Mode == nagiosMode {
+		event.DeepUpdate(nagiosEvent(result, nagios))
+	}
+	return event
 }
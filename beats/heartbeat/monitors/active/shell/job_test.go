@@ -0,0 +1,223 @@
+package shell
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/local"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/ssh"
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+)
+
+func Test_make_rtt(t *testing.T) {
+	result := &util.Result{Timings: util.Timings{
+		Connect:   2 * time.Millisecond,
+		Handshake: 3 * time.Millisecond,
+		Exec:      10 * time.Millisecond,
+		Total:     16 * time.Millisecond,
+	}}
+	assert.Equal(t, common.MapStr{
+		"connect":   common.MapStr{"us": time.Duration(2000)},
+		"handshake": common.MapStr{"us": time.Duration(3000)},
+		"exec":      common.MapStr{"us": time.Duration(10000)},
+		"total":     common.MapStr{"us": time.Duration(16000)},
+	}, makeRTT(result, 20*time.Millisecond))
+
+	// the measured duration is the total of a failed run
+	assert.Equal(t, common.MapStr{
+		"total": common.MapStr{"us": time.Duration(20000)},
+	}, makeRTT(nil, 20*time.Millisecond))
+}
+
+func Test_docker_tls(t *testing.T) {
+	tlsConfig, err := dockerTLS("tcp://docker.example.com:2376", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	disabled := false
+	tlsConfig, err = dockerTLS("tcp://docker.example.com:2376", &tlscommon.Config{Enabled: &disabled})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = dockerTLS("tcp://docker.example.com:2376", &tlscommon.Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "docker.example.com", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	tlsConfig, err = dockerTLS("tcp://10.0.0.1:2376", &tlscommon.Config{VerificationMode: tlscommon.VerifyNone})
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+
+	_, err = dockerTLS("tcp://docker.example.com:2376", &tlscommon.Config{CAs: []string{"/nonexistent/ca.pem"}})
+	assert.Error(t, err)
+}
+
+func Test_parse_ssh_endpoint(t *testing.T) {
+	cases := []struct {
+		addr                   string
+		host, username, socket string
+	}{
+		{"ssh://docker.example.com", "docker.example.com:22", "monitor", "/var/run/docker.sock"},
+		{"ssh://deploy@docker.example.com:2222/", "docker.example.com:2222", "deploy", "/var/run/docker.sock"},
+		{"ssh://deploy@10.0.0.1/run/user/1000/docker.sock", "10.0.0.1:22", "deploy", "/run/user/1000/docker.sock"},
+	}
+	for _, c := range cases {
+		host, username, socket, err := parseSSHEndpoint(c.addr, "monitor")
+		assert.NoError(t, err, c.addr)
+		assert.Equal(t, c.host, host, c.addr)
+		assert.Equal(t, c.username, username, c.addr)
+		assert.Equal(t, c.socket, socket, c.addr)
+	}
+
+	_, _, _, err := parseSSHEndpoint("ssh:///var/run/docker.sock", "monitor")
+	assert.Error(t, err)
+}
+
+func Test_docker_ssh_endpoint_config(t *testing.T) {
+	config := defaultConfig()
+	config.Docker.Enabled = true
+	config.Dockerfilter = []string{"name:web"}
+	config.Hosts = []string{"ssh://deploy@docker.example.com"}
+	assert.Error(t, config.Validate())
+
+	config.Password = "secret"
+	assert.NoError(t, config.Validate())
+
+	config.Hosts = []string{"ssh://docker.example.com"}
+	assert.Error(t, config.Validate())
+
+	config.Username = "monitor"
+	assert.NoError(t, config.Validate())
+
+	config.TLS = &tlscommon.Config{}
+	assert.Error(t, config.Validate())
+}
+
+func Test_docker_ssh_endpoint(t *testing.T) {
+	config := defaultConfig()
+	config.Password = "secret"
+	api, err := openDockerAPI("ssh://deploy@docker.example.com", &config)
+	assert.NoError(t, err)
+	assert.Nil(t, api.tls)
+	assert.True(t, strings.HasPrefix(api.endpoint, "unix://"), api.endpoint)
+	socket := strings.TrimPrefix(api.endpoint, "unix://")
+	_, err = os.Stat(socket)
+	assert.NoError(t, err)
+	_, ok := api.comm(api.client(&config)).(*forwardedClient)
+	assert.True(t, ok)
+
+	// the monitors of the same endpoint share the socket until the last one is closed
+	other, err := openDockerAPI("ssh://deploy@docker.example.com", &config)
+	assert.NoError(t, err)
+	assert.Equal(t, api.endpoint, other.endpoint)
+	api.Close()
+	_, err = os.Stat(socket)
+	assert.NoError(t, err)
+	other.Close()
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+
+	api, err = openDockerAPI("tcp://docker.example.com:2375", &config)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://docker.example.com:2375", api.endpoint)
+	api.Close()
+}
+
+func Test_docker_ssh_endpoint_reload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	// the endpoint refuses the connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener.Close()
+
+	config := defaultConfig()
+	config.Hosts = []string{"ssh://deploy@" + listener.Addr().String()}
+	config.Password = "secret"
+	config.Docker = dockerConfig{Enabled: true, IdleTimeout: 50 * time.Millisecond}
+	config.Dockerfilter = []string{"name:web"}
+	config.Timeout = time.Second
+	config.Check.Request.Command = "true"
+
+	// the monitor is created again by each reload, the jobs of the previous one aren't closed
+	for i := 0; i < 3; i++ {
+		job, err := newShellMonitorJob(config.Hosts[0], &config, makeValidator(&config))
+		assert.NoError(t, err)
+		_, _, err = job.Run()
+		assert.Error(t, err)
+	}
+	config.Docker.Discovery = true
+	job, err := newShellMonitorJob(config.Hosts[0], &config, makeValidator(&config))
+	assert.NoError(t, err)
+	_, _, err = job.Run()
+	assert.Error(t, err)
+
+	// the forwarded sockets are removed once the jobs are idle
+	var left []os.FileInfo
+	for i := 0; i < 100; i++ {
+		left, err = ioutil.ReadDir(tmp)
+		assert.NoError(t, err)
+		if len(left) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, left)
+}
+
+func Test_make_event_output(t *testing.T) {
+	event := makeEvent(&checkConfig{}, &util.Result{Stdout: "out", Stderr: "err"}, nil)
+	output, _ := event.GetValue("shell.response.output")
+	stdout, _ := event.GetValue("shell.response.stdout")
+	stderr, _ := event.GetValue("shell.response.stderr")
+	assert.Equal(t, "out", output)
+	assert.Equal(t, "out", stdout)
+	assert.Equal(t, "err", stderr)
+}
+
+func Test_request_shell_default(t *testing.T) {
+	config := defaultConfig()
+	config.Hosts = []string{"localhost:22"}
+	client, err := createClinet("localhost:22", &config)
+	assert.NoError(t, err)
+	assert.False(t, client.(*local.LocalClient).Shell)
+
+	config.Username = "monitor"
+	config.Password = "secret"
+	client, err = createClinet("monitor.example.com:22", &config)
+	assert.NoError(t, err)
+	assert.True(t, client.(*ssh.SSHClient).Shell)
+
+	shell := true
+	config.Check.Request.Shell = &shell
+	client, err = createClinet("localhost:22", &config)
+	assert.NoError(t, err)
+	assert.True(t, client.(*local.LocalClient).Shell)
+}
+
+func Test_run_timeout(t *testing.T) {
+	config := defaultConfig()
+	config.Check.Request.Command = "sleep"
+	config.Check.Request.Args = []string{"5"}
+	config.Timeout = 100 * time.Millisecond
+	run := makeRun(&config, nil, nil, makeValidator(&config))
+
+	client := local.NewLocalClient()
+	client.KillGracePeriod = 100 * time.Millisecond
+	start := time.Now()
+	_, err := run(client)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
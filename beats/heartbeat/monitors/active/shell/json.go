@@ -0,0 +1,232 @@
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+var (
+	errJSONPathNotFound = errors.New("The JSON path doesn't exist")
+	errJSONTruncated    = errors.New("The output is truncated, raise check.output.max_bytes to decode it as JSON")
+
+	jsonOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+)
+
+// jsonAssertion is an expression like `status == "green"` or `items[0].replicas >= 3`
+type jsonAssertion struct {
+	expr     string
+	path     []jsonPathElement
+	operator string
+	value    interface{}
+}
+
+// jsonPathElement is a field name or an index into an array
+type jsonPathElement struct {
+	field string
+	index int
+}
+
+func decodeJSON(output string) (interface{}, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(output), &doc); err != nil {
+		return nil, fmt.Errorf("Failed to decode the output as JSON: %v", err)
+	}
+	return doc, nil
+}
+
+// checkJSON decodes the whole stdout, a stdout truncated by the max bytes fails the check
+func checkJSON(config *jsonConfig, maxBytes int) ResultCheck {
+	// the assertions are verified by jsonConfig.Validate
+	assertions, _ := parseJSONAssertions(config.Assertions)
+
+	return func(result *util.Result) error {
+		if stdoutTruncated(result, maxBytes) {
+			return errJSONTruncated
+		}
+		doc, err := decodeJSON(result.Stdout)
+		if err != nil {
+			return err
+		}
+		for _, assertion := range assertions {
+			if err := assertion.check(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func parseJSONAssertions(exprs []string) ([]jsonAssertion, error) {
+	assertions := make([]jsonAssertion, 0, len(exprs))
+	for _, expr := range exprs {
+		assertion, err := parseJSONAssertion(expr)
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions, nil
+}
+
+func parseJSONAssertion(expr string) (jsonAssertion, error) {
+	assertion := jsonAssertion{expr: expr}
+
+	pos := -1
+	for i := 0; i < len(expr) && pos < 0; i++ {
+		for _, op := range jsonOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				pos = i
+				assertion.operator = op
+				break
+			}
+		}
+	}
+	if pos < 0 {
+		return assertion, fmt.Errorf("Missing operator in JSON assertion '%v'", expr)
+	}
+
+	path, err := parseJSONPath(strings.TrimSpace(expr[:pos]))
+	if err != nil {
+		return assertion, fmt.Errorf("Invalid path in JSON assertion '%v': %v", expr, err)
+	}
+	assertion.path = path
+
+	literal := strings.TrimSpace(expr[pos+len(assertion.operator):])
+	if err := json.Unmarshal([]byte(literal), &assertion.value); err != nil {
+		return assertion, fmt.Errorf("Invalid value in JSON assertion '%v': %v", expr, err)
+	}
+	switch assertion.value.(type) {
+	case string, float64, bool, nil:
+	default:
+		return assertion, fmt.Errorf("Only strings, numbers, booleans and null can be compared in JSON assertion '%v'", expr)
+	}
+	return assertion, nil
+}
+
+// parseJSONPath parses paths like `$.items[0].status`, the leading `$` is optional
+// and a single `$` is the whole document.
+func parseJSONPath(path string) ([]jsonPathElement, error) {
+	var elements []jsonPathElement
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+	if path == "$" {
+		return elements, nil
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if pos := strings.Index(part, "["); pos >= 0 {
+			name = part[:pos]
+			part = part[pos:]
+		} else {
+			part = ""
+		}
+		if name == "" && part == "" {
+			return nil, errors.New("empty field name")
+		}
+		if name != "" {
+			elements = append(elements, jsonPathElement{field: name})
+		}
+		for part != "" {
+			end := strings.Index(part, "]")
+			if !strings.HasPrefix(part, "[") || end < 0 {
+				return nil, fmt.Errorf("invalid index in '%v'", part)
+			}
+			index, err := strconv.Atoi(part[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in '%v'", part)
+			}
+			elements = append(elements, jsonPathElement{index: index})
+			part = part[end+1:]
+		}
+	}
+	return elements, nil
+}
+
+func lookupJSONPath(doc interface{}, path []jsonPathElement) (interface{}, error) {
+	current := doc
+	for _, element := range path {
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[element.field]
+			if element.field == "" || !ok {
+				return nil, errJSONPathNotFound
+			}
+			current = next
+		case []interface{}:
+			if element.field != "" || element.index >= len(value) {
+				return nil, errJSONPathNotFound
+			}
+			current = value[element.index]
+		default:
+			return nil, errJSONPathNotFound
+		}
+	}
+	return current, nil
+}
+
+func (a jsonAssertion) check(doc interface{}) error {
+	actual, err := lookupJSONPath(doc, a.path)
+	if err != nil {
+		return fmt.Errorf("JSON assertion '%v' failed: %v", a.expr, err)
+	}
+	if !a.compare(actual) {
+		return fmt.Errorf("JSON assertion '%v' failed: the value is %v", a.expr, actual)
+	}
+	return nil
+}
+
+func (a jsonAssertion) compare(actual interface{}) bool {
+	// objects and arrays are never equal to the scalar value
+	_, isObject := actual.(map[string]interface{})
+	_, isArray := actual.([]interface{})
+	switch a.operator {
+	case "==":
+		return !isObject && !isArray && actual == a.value
+	case "!=":
+		return isObject || isArray || actual != a.value
+	}
+
+	// ordering is only defined for two numbers or two strings
+	var cmp int
+	switch expected := a.value.(type) {
+	case float64:
+		number, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case number < expected:
+			cmp = -1
+		case number > expected:
+			cmp = 1
+		}
+	case string:
+		str, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(str, expected)
+	default:
+		return false
+	}
+
+	switch a.operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return false
+}
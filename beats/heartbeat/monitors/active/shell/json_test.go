@@ -0,0 +1,58 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+func Test_json_assertions(t *testing.T) {
+	output := `{"status": "green", "replicas": 3, "nodes": [{"name": "a"}, {"name": "b"}], "ready": true, "error": null}`
+
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{`status == "green"`, true},
+		{`status != "green"`, false},
+		{`$.status == "red"`, false},
+		{`replicas >= 3`, true},
+		{`replicas > 3`, false},
+		{`replicas<4`, true},
+		{`nodes[1].name == "b"`, true},
+		{`$.nodes[2].name == "c"`, false},
+		{`nodes == 2`, false},
+		{`nodes != 2`, true},
+		{`ready == true`, true},
+		{`error == null`, true},
+		{`missing == 1`, false},
+		{`status >= 3`, false},
+	}
+
+	for _, test := range tests {
+		cfg := &jsonConfig{Assertions: []string{test.expr}}
+		assert.NoError(t, cfg.Validate(), test.expr)
+		err := checkJSON(cfg, 0)(&util.Result{Stdout: output})
+		if test.ok {
+			assert.NoError(t, err, test.expr)
+		} else {
+			assert.Error(t, err, test.expr)
+		}
+	}
+
+	assert.Error(t, checkJSON(&jsonConfig{}, 0)(&util.Result{Stdout: "not json"}))
+
+	// a truncated output isn't decoded
+	truncated := &util.Result{Stdout: `{"status": "gr\n... 10 bytes truncated ...\n"}`, StdoutBytes: 40, Truncated: true}
+	assert.Equal(t, errJSONTruncated, checkJSON(&jsonConfig{}, 30)(truncated))
+	assert.NoError(t, checkJSON(&jsonConfig{}, len(output))(&util.Result{Stdout: output, StdoutBytes: int64(len(output))}))
+}
+
+func Test_invalid_json_assertions(t *testing.T) {
+	for _, expr := range []string{`status`, `status == green`, `== 1`, `a..b == 1`, `a[x] == 1`, `a == [1]`} {
+		_, err := parseJSONAssertion(expr)
+		assert.Error(t, err, expr)
+	}
+}
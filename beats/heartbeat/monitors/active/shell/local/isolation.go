@@ -0,0 +1,118 @@
+package local
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gateScript holds the command until its limits are set, the exec of the command inherits them.
+// The gate exits without running the command if the limits failed.
+const gateScript = `read -r _ <&3 || exit 126; exec 3<&-; exec "$@"`
+
+// procScript mounts the proc of the pid namespace of the sandbox over the /proc of the host, the
+// mount is private to the mount namespace of the sandbox. It exits without running the command
+// if the mount failed.
+const procScript = `mount -t proc proc /proc || exit 126; exec "$@"`
+
+// Limits are the resource limits of the command and its children, the zero values are unlimited
+type Limits struct {
+	// CPU is the CPU time of each process, rounded up to seconds
+	CPU time.Duration
+	// Memory is the address space of each process in bytes
+	Memory int64
+	// OpenFiles is the max number of open file descriptors of each process
+	OpenFiles uint64
+	// Processes is the max number of processes of the user running the command
+	Processes uint64
+}
+
+func (l Limits) isSet() bool {
+	return l != Limits{}
+}
+
+func (l Limits) cpuSeconds() uint64 {
+	return uint64((l.CPU + time.Second - 1) / time.Second)
+}
+
+// runAs is the resolved user and group running the command
+type runAs struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	name   string
+	home   string
+}
+
+// CheckRunAs checks that the user and optional group of a user or user:group exist
+func CheckRunAs(value string) error {
+	_, err := lookupRunAs(value)
+	return err
+}
+
+// lookupRunAs resolves a user or user:group by name or id. The group defaults to the primary
+// group of the user, the supplementary groups of the user are kept.
+func lookupRunAs(value string) (*runAs, error) {
+	name, groupName := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		name, groupName = value[:i], value[i+1:]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("The user of run_as '%v' is required", value)
+	}
+
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unknown run_as user '%v': %v", name, err)
+	}
+	r := &runAs{name: u.Username, home: u.HomeDir}
+	if r.uid, err = parseID(u.Uid); err != nil {
+		return nil, err
+	}
+
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unknown run_as group '%v': %v", groupName, err)
+		}
+		gid = g.Gid
+	}
+	if r.gid, err = parseID(gid); err != nil {
+		return nil, err
+	}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		id, err := parseID(group)
+		if err != nil {
+			return nil, err
+		}
+		r.groups = append(r.groups, id)
+	}
+	return r, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Unsupported user or group id '%v'", id)
+	}
+	return uint32(n), nil
+}
+
+// env is the login environment of the user, the environment of the beat is kept otherwise
+func (r *runAs) env() []string {
+	return []string{"HOME=" + r.home, "USER=" + r.name, "LOGNAME=" + r.name}
+}
@@ -0,0 +1,56 @@
+package local
+
+import (
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCredential runs the command as the user, the switch happens in the child before the exec
+func setCredential(cmd *exec.Cmd, r *runAs) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    r.uid,
+		Gid:    r.gid,
+		Groups: r.groups,
+	}
+	return nil
+}
+
+// setSandbox starts the command in new pid and net namespaces, and unshares the mount namespace
+// with private mounts. The command is the init of its pid namespace, it ignores the SIGTERM
+// without a handler and is killed after the grace period.
+func setSandbox(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+	return nil
+}
+
+// setLimits sets the soft and hard limits of the process, the command can't raise them
+func setLimits(pid int, limits Limits) error {
+	values := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, limits.cpuSeconds()},
+		{unix.RLIMIT_AS, uint64(limits.Memory)},
+		{unix.RLIMIT_NOFILE, limits.OpenFiles},
+		{unix.RLIMIT_NPROC, limits.Processes},
+	}
+	for _, v := range values {
+		if v.value == 0 {
+			continue
+		}
+		rlimit := &unix.Rlimit{Cur: v.value, Max: v.value}
+		if err := unix.Prlimit(pid, v.resource, rlimit, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+var errUnsupported = fmt.Errorf("local.run_as, limits and sandbox are only supported on linux")
+
+func setCredential(cmd *exec.Cmd, r *runAs) error {
+	return errUnsupported
+}
+
+func setSandbox(cmd *exec.Cmd) error {
+	return errUnsupported
+}
+
+func setLimits(pid int, limits Limits) error {
+	return errUnsupported
+}
@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package local
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching the user requires root")
+	}
+}
+
+func Test_lookup_run_as(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	r, err := lookupRunAs("nobody")
+	assert.NoError(t, err)
+	assert.Equal(t, nobody.Uid, formatID(r.uid))
+	assert.Equal(t, nobody.Gid, formatID(r.gid))
+
+	r, err = lookupRunAs(nobody.Uid + ":0")
+	assert.NoError(t, err)
+	assert.Equal(t, "nobody", r.name)
+	assert.Equal(t, uint32(0), r.gid)
+
+	for _, value := range []string{"", ":0", "no_such_user", "nobody:no_such_group"} {
+		_, err := lookupRunAs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func Test_local_run_as(t *testing.T) {
+	requireRoot(t)
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	comm := &LocalClient{Shell: true, RunAs: "nobody"}
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{
+		Script: []byte(`id -u; echo "$USER"`),
+		Dir:    "/",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, out.ExitCode, out.Stderr)
+	assert.Equal(t, nobody.Uid+"\nnobody\n", out.Stdout)
+}
+
+func Test_local_limits(t *testing.T) {
+	comm := &LocalClient{
+		Shell: true,
+		Limits: Limits{
+			CPU:       1500 * time.Millisecond,
+			Memory:    1 << 30,
+			OpenFiles: 64,
+		},
+	}
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{Command: "cat /proc/self/limits"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, out.ExitCode, out.Stderr)
+
+	limits := map[string][]string{}
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && strings.HasPrefix(line, "Max ") {
+			limits[strings.Join(fields[:len(fields)-3], " ")] = fields[len(fields)-3 : len(fields)-1]
+		}
+	}
+	assert.Equal(t, []string{"2", "2"}, limits["Max cpu time"])
+	assert.Equal(t, []string{"1073741824", "1073741824"}, limits["Max address space"])
+	assert.Equal(t, []string{"64", "64"}, limits["Max open files"])
+
+	// the command can't raise them
+	out, err = comm.RunContext(context.Background(), &util.RunRequest{Command: "ulimit -n 128"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, out.ExitCode)
+}
+
+func Test_local_limits_kill(t *testing.T) {
+	comm := &LocalClient{Shell: true, Limits: Limits{CPU: time.Second}}
+	start := time.Now()
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{Command: "while :; do :; done"})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, "", out.Stdout)
+}
+
+func Test_local_sandbox(t *testing.T) {
+	requireRoot(t)
+	comm := &LocalClient{Shell: true, Sandbox: true}
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{Command: "readlink /proc/self/ns/net /proc/self/ns/pid; echo $$; ls -d /proc/[0-9]* | wc -l"})
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skip("namespaces aren't allowed: ", err)
+	}
+	assert.NoError(t, err)
+
+	lines := strings.Fields(out.Stdout)
+	assert.Len(t, lines, 4)
+	for i, ns := range []string{"/proc/self/ns/net", "/proc/self/ns/pid"} {
+		beat, err := os.Readlink(ns)
+		assert.NoError(t, err)
+		assert.NotEqual(t, beat, lines[i])
+	}
+	// the command is the init of its pid namespace, the /proc only shows the sandbox
+	assert.Equal(t, "1", lines[2])
+	processes, err := strconv.Atoi(lines[3])
+	assert.NoError(t, err)
+	assert.True(t, processes < 5, out.Stdout)
+
+	// the /proc of the beat is left as is
+	_, err = os.Stat("/proc/" + strconv.Itoa(os.Getpid()))
+	assert.NoError(t, err)
+}
+
+func formatID(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -2,28 +2,152 @@ package local
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
 	"time"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 )
 
+const shellCommand = "/bin/sh"
+
 type LocalClient struct {
 	Timeout time.Duration
+	// Shell runs the command as a shell snippet with /bin/sh, otherwise it's executed with args
+	Shell bool
+	// Env is added to the environment of the beat
+	Env map[string]string
+	// KillGracePeriod is the time the process group of a cancelled command has to exit after
+	// the SIGTERM, before it's killed
+	KillGracePeriod time.Duration
+	// RunAs is the user or user:group running the command, the beat must be allowed to switch to it
+	RunAs string
+	// Limits are the resource limits of the command
+	Limits Limits
+	// Sandbox runs the command in new mount, pid and net namespaces with its own /proc
+	Sandbox bool
 }
 
 func NewLocalClient() *LocalClient {
-	return &LocalClient{}
+	return &LocalClient{KillGracePeriod: DefaultKillGracePeriod}
 }
 
-func (c *LocalClient) Run(dir, command string, args ...string) (string, error) {
+// Run runs the command with the Timeout
+func (c *LocalClient) Run(dir, command string, args ...string) (*util.Result, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
 	defer cancel()
+	return c.RunContext(ctx, &util.RunRequest{Dir: dir, Command: command, Args: args})
+}
+
+// RunContext runs the request until it exits, the process group is killed once the ctx is done.
+// A script is run from a temporary file, which is removed after the run.
+func (c *LocalClient) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	start := time.Now()
+	var user *runAs
+	if c.RunAs != "" {
+		var err error
+		if user, err = lookupRunAs(c.RunAs); err != nil {
+			return nil, err
+		}
+	}
+
+	command, args := req.Command, req.Args
+	if req.Script != nil {
+		path, err := util.WriteTempScript(req.Script)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(path)
+		if user != nil {
+			if err := os.Chown(path, int(user.uid), int(user.gid)); err != nil {
+				return nil, err
+			}
+		}
+		command, args = util.ScriptCommand(req.Interpreter, path, args)
+	}
+
+	var argv []string
+	if c.Shell {
+		argv = []string{shellCommand, "-c", util.BuildCmd(true, "", command, args...)}
+	} else {
+		argv = append([]string{command}, args...)
+	}
+	// the proc can only be mounted by the beat, the commands run as another user see the /proc
+	// of the host
+	if c.Sandbox && user == nil {
+		argv = append([]string{shellCommand, "-c", procScript, shellCommand}, argv...)
+	}
+	if c.Limits.isSet() {
+		argv = append([]string{shellCommand, "-c", gateScript, shellCommand}, argv...)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	if req.Dir != "" {
+		cmd.Dir = req.Dir
+	}
+	if user != nil || len(c.Env) > 0 {
+		cmd.Env = os.Environ()
+	}
+	if user != nil {
+		cmd.Env = append(cmd.Env, user.env()...)
+		if err := setCredential(cmd, user); err != nil {
+			return nil, err
+		}
+	}
+	cmd.Env = append(cmd.Env, util.EnvList(c.Env)...)
+	if c.Sandbox {
+		if err := setSandbox(cmd); err != nil {
+			return nil, err
+		}
+	}
+	outputs := util.NewOutputs(req)
+	cmd.Stdin = req.Stdin
+	cmd.Stdout = outputs.StdoutWriter
+	cmd.Stderr = outputs.Stderr
 
-	cmd := exec.CommandContext(ctx, command, args...)
-	if dir != "" {
-		cmd.Dir = dir
+	var started func() error
+	if c.Limits.isSet() {
+		gate, release, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer gate.Close()
+		defer release.Close()
+		cmd.ExtraFiles = []*os.File{gate}
+		started = func() error {
+			gate.Close()
+			if err := setLimits(cmd.Process.Pid, c.Limits); err != nil {
+				return fmt.Errorf("Failed to set the limits of the command: %v", err)
+			}
+			_, err := release.Write([]byte("\n"))
+			return err
+		}
+	}
+
+	execStart := time.Now()
+	err := runProcessGroup(ctx, cmd, c.KillGracePeriod, started)
+	end := time.Now()
+
+	result := &util.Result{
+		Timings: util.Timings{
+			Start: start,
+			Exec:  end.Sub(execStart),
+			Total: end.Sub(start),
+		},
+	}
+	outputs.SetResult(result)
+	if cmd.Process != nil {
+		result.Metadata = map[string]interface{}{"pid": cmd.Process.Pid}
+	}
+	// a non zero exit status is a valid result, only a killed or not started process is an error
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			result.ExitCode = status.ExitStatus()
+			return result, nil
+		}
 	}
-	output, err := cmd.Output()
-	return string(output), err
+	return result, err
 }
 
 func (c *LocalClient) Connect() error {
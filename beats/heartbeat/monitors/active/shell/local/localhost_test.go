@@ -1,12 +1,16 @@
 package local
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 )
 
 func Test_run_local_output(t *testing.T) {
@@ -24,8 +28,9 @@ func Test_run_local_output(t *testing.T) {
 	f.Close()
 
 	out, err := comm.Run(folder, "/bin/bash", "test.sh")
-	assert.Equal(t, "test test1\n", out)
 	assert.NoError(t, err, "Failed by running comm.Output")
+	assert.Equal(t, "test test1\n", out.Stdout)
+	assert.Equal(t, 0, out.ExitCode)
 
 }
 
@@ -48,5 +53,131 @@ func Test_local_timeout(t *testing.T) {
 	f.Close()
 
 	_, err = comm.Run(folder, "/bin/bash", "test.sh")
-	assert.EqualError(t, err, "signal: killed")
+	assert.EqualError(t, err, "The command is killed: context deadline exceeded")
+}
+
+func Test_local_exit_code(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 2 * time.Second,
+	}
+
+	out, err := comm.Run("", "/bin/sh", "-c", "echo warning; exit 2")
+	assert.NoError(t, err, "A non zero exit code should not be an error")
+	assert.Equal(t, "warning\n", out.Stdout)
+	assert.Equal(t, 2, out.ExitCode)
+}
+
+func Test_local_stderr(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 2 * time.Second,
+	}
+
+	out, err := comm.Run("", "/bin/sh", "-c", "echo out; echo err >&2")
+	assert.NoError(t, err, "Writing to stderr should not be an error")
+	assert.Equal(t, "out\n", out.Stdout)
+	assert.Equal(t, "err\n", out.Stderr)
+	assert.Equal(t, 0, out.ExitCode)
+}
+
+func Test_local_env(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 2 * time.Second,
+		Shell:   true,
+		Env:     map[string]string{"SHELL_MONITOR_TEST": "it's set"},
+	}
+
+	out, err := comm.Run("", `echo "$SHELL_MONITOR_TEST"; test -n "$PATH"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "it's set\n", out.Stdout)
+	assert.Equal(t, 0, out.ExitCode)
+}
+
+func Test_local_script(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 2 * time.Second,
+	}
+
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{
+		Dir:         "/tmp",
+		Script:      []byte("echo \"$0\" >&2\npwd\necho \"$1\"\nexit 3\n"),
+		Interpreter: "/bin/sh",
+		Args:        []string{"a b"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp\na b\n", out.Stdout)
+	assert.Equal(t, 3, out.ExitCode)
+
+	// the temporary script is removed
+	_, err = os.Stat(strings.TrimSpace(out.Stderr))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_local_stdin(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 2 * time.Second,
+	}
+
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{
+		Command: "wc",
+		Args:    []string{"-l"},
+		Stdin:   strings.NewReader("line1\nline2\n"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", strings.TrimSpace(out.Stdout))
+
+	out, err = comm.RunContext(context.Background(), &util.RunRequest{
+		Script: []byte("cat"),
+		Stdin:  strings.NewReader("from stdin"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "from stdin", out.Stdout)
+}
+
+func Test_local_cancel(t *testing.T) {
+	comm := &LocalClient{
+		Timeout: 10 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	out, err := comm.RunContext(ctx, &util.RunRequest{Command: "sleep", Args: []string{"5"}})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	out, err = comm.RunContext(context.Background(), &util.RunRequest{Command: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, out.ExitCode)
+	assert.True(t, out.Timings.Total >= out.Timings.Exec)
+	assert.NotNil(t, out.Metadata["pid"])
+}
+
+func Test_local_max_bytes(t *testing.T) {
+	comm := &LocalClient{Shell: true}
+	var whole strings.Builder
+	out, err := comm.RunContext(context.Background(), &util.RunRequest{
+		Command:  "seq 1 100000",
+		MaxBytes: 1024,
+		Output:   &whole,
+	})
+	assert.NoError(t, err)
+	assert.True(t, out.Truncated)
+	assert.Equal(t, int64(588895), out.StdoutBytes)
+	assert.True(t, strings.HasPrefix(out.Stdout, "1\n2\n3\n"))
+	assert.True(t, strings.HasSuffix(out.Stdout, "99999\n100000\n"))
+	assert.True(t, len(out.Stdout) < 1100)
+	assert.Equal(t, 588895, whole.Len())
+}
+
+func Test_local_default_argv(t *testing.T) {
+	comm := NewLocalClient()
+	comm.Timeout = 2 * time.Second
+
+	// without shell the command is executed, not parsed by /bin/sh
+	_, err := comm.Run("", "echo hi; echo there")
+	assert.Error(t, err)
+
+	out, err := comm.Run("", "/bin/echo", "$HOME", "a;b")
+	assert.NoError(t, err)
+	assert.Equal(t, "$HOME a;b\n", out.Stdout)
 }
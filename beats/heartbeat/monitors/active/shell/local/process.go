@@ -0,0 +1,59 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const (
+	// DefaultKillGracePeriod is the time between the SIGTERM and the SIGKILL of a cancelled command
+	DefaultKillGracePeriod = 2 * time.Second
+
+	groupPollInterval = 50 * time.Millisecond
+)
+
+// runProcessGroup runs the command in its own process group. Once the ctx is done, the whole
+// group is terminated, and the processes still running after the grace period are killed.
+// The grandchildren are killed with the command, they would keep its output open otherwise.
+// The started func is called once the command is started, the group is killed if it fails.
+func runProcessGroup(ctx context.Context, cmd *exec.Cmd, grace time.Duration, started func() error) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	if started != nil {
+		if err := started(); err != nil {
+			killGroup(cmd)
+			<-done
+			return err
+		}
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if terminateGroup(cmd) {
+		deadline := time.Now().Add(grace)
+		for groupExists(cmd) && time.Now().Before(deadline) {
+			select {
+			case <-done:
+				// the command is reaped, its children may still be running
+				done = nil
+			case <-time.After(groupPollInterval):
+			}
+		}
+		killGroup(cmd)
+	}
+	if done != nil {
+		<-done
+	}
+	return fmt.Errorf("The command is killed: %v", ctx.Err())
+}
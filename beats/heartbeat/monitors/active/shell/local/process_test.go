@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+// running is false once the process is gone, or is a zombie waiting for init
+func running(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func Test_local_timeout_kills_grandchildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process_group")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pids := filepath.Join(dir, "pids")
+
+	// a background grandchild keeping the output open, and one ignoring SIGTERM
+	script := `
+sleep 30 &
+echo $! >> ` + pids + `
+sh -c 'trap "" TERM; echo $$ >> ` + pids + `; sleep 30' &
+sleep 30
+`
+	comm := &LocalClient{
+		Timeout:         500 * time.Millisecond,
+		KillGracePeriod: 500 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), comm.Timeout)
+	defer cancel()
+	start := time.Now()
+	_, err = comm.RunContext(ctx, &util.RunRequest{Script: []byte(script)})
+	assert.EqualError(t, err, "The command is killed: context deadline exceeded")
+	assert.True(t, time.Since(start) < 5*time.Second, "the run must not wait for the grandchildren")
+
+	data, err := ioutil.ReadFile(pids)
+	assert.NoError(t, err)
+	lines := strings.Fields(string(data))
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		pid, err := strconv.Atoi(line)
+		assert.NoError(t, err)
+		// the killed orphans are reaped by init
+		for i := 0; i < 20 && running(pid); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		assert.False(t, running(pid), "the grandchild %v survived the timeout", pid)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package local
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a new process group, which includes all its children
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends the signal to the process group of the command, it's false once the group is gone
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) bool {
+	return syscall.Kill(-cmd.Process.Pid, sig) != syscall.ESRCH
+}
+
+func terminateGroup(cmd *exec.Cmd) bool {
+	return signalGroup(cmd, syscall.SIGTERM)
+}
+
+func killGroup(cmd *exec.Cmd) {
+	signalGroup(cmd, syscall.SIGKILL)
+}
+
+// groupExists is true while any process of the group is running
+func groupExists(cmd *exec.Cmd) bool {
+	return signalGroup(cmd, 0)
+}
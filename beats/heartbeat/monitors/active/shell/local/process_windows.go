@@ -0,0 +1,22 @@
+package local
+
+import (
+	"os/exec"
+)
+
+// Windows has no process groups, only the process itself is killed
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateGroup(cmd *exec.Cmd) bool {
+	cmd.Process.Kill()
+	return false
+}
+
+func killGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func groupExists(cmd *exec.Cmd) bool {
+	return false
+}
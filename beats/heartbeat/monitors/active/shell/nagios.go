@@ -0,0 +1,328 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const nagiosMode = "nagios"
+
+// the return codes of a nagios plugin
+const (
+	nagiosOk = iota
+	nagiosWarning
+	nagiosCritical
+	nagiosUnknown
+)
+
+var (
+	errNagiosWarning  = errors.New("The nagios plugin returns warning")
+	errNagiosCritical = errors.New("The nagios plugin returns critical")
+	errNagiosUnknown  = errors.New("The nagios plugin returns unknown")
+
+	// the shell status of each nagios return code
+	nagiosStatus = []string{"up", Warning, "down", Unknown}
+
+	perfdataValue = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)(.*)$`)
+)
+
+type nagiosOutput struct {
+	Text     string
+	LongText string
+	Perfdata []perfdata
+}
+
+// perfdata is a single 'label'=value[UOM];[warn];[crit];[min];[max] item
+type perfdata struct {
+	Label string
+	Value float64
+	UOM   string
+	Warn  string
+	Crit  string
+	Min   *float64
+	Max   *float64
+}
+
+// nagiosState returns the nagios state of the exit code, any unexpected code is unknown.
+func nagiosState(exitCode int) int {
+	if exitCode < nagiosOk || exitCode > nagiosUnknown {
+		return nagiosUnknown
+	}
+	return exitCode
+}
+
+// checkNagios fails the check if the plugin returns critical or unknown, and on warning if it's
+// reported as down by warning_as
+func checkNagios(warningAs string) ResultCheck {
+	return func(result *util.Result) error {
+		switch nagiosState(result.ExitCode) {
+		case nagiosWarning:
+			if warningAs == "down" {
+				return errNagiosWarning
+			}
+		case nagiosCritical:
+			return errNagiosCritical
+		case nagiosUnknown:
+			return errNagiosUnknown
+		}
+		return nil
+	}
+}
+
+// nagiosEvent reports the status and the parsed output of the plugin, a stdout truncated by the
+// max_bytes is parsed from the first line and the performance data kept by the scanner.
+func nagiosEvent(result *util.Result, scanner *nagiosScanner) common.MapStr {
+	stdout := result.Stdout
+	if scanner != nil && stdoutTruncated(result, scanner.max) {
+		stdout = scanner.String()
+	}
+	output := parseNagiosOutput(stdout)
+	nagios := common.MapStr{
+		"output": output.Text,
+	}
+	if output.LongText != "" {
+		nagios["long_output"] = output.LongText
+	}
+
+	shell := common.MapStr{
+		"status": nagiosStatus[nagiosState(result.ExitCode)],
+		"nagios": nagios,
+	}
+	if len(output.Perfdata) > 0 {
+		fields := common.MapStr{}
+		for _, p := range output.Perfdata {
+			fields[perfdataKey(p.Label)] = p.fields()
+		}
+		shell["perfdata"] = fields
+	}
+	return common.MapStr{"shell": shell}
+}
+
+func (p perfdata) fields() common.MapStr {
+	fields := common.MapStr{
+		"value": p.Value,
+	}
+	if p.UOM != "" {
+		fields["uom"] = p.UOM
+	}
+	if p.Warn != "" {
+		fields["warn"] = p.Warn
+	}
+	if p.Crit != "" {
+		fields["crit"] = p.Crit
+	}
+	if p.Min != nil {
+		fields["min"] = *p.Min
+	}
+	if p.Max != nil {
+		fields["max"] = *p.Max
+	}
+	return fields
+}
+
+// perfdataKey avoids labels being split into nested fields
+func perfdataKey(label string) string {
+	return strings.NewReplacer(".", "_", " ", "_").Replace(label)
+}
+
+// nagiosScanner keeps the first line, the long text and the performance data of the plugin output
+// while it's read, each of them is cut at max bytes. The performance data at the end of a long
+// output are kept even if the stdout is truncated.
+type nagiosScanner struct {
+	max    int
+	lines  int
+	inPerf bool
+	first  []byte
+	long   []byte
+	perf   []byte
+}
+
+func newNagiosScanner(max int) *nagiosScanner {
+	return &nagiosScanner{max: max}
+}
+
+func (s *nagiosScanner) Write(p []byte) (int, error) {
+	rest := p
+	for len(rest) > 0 {
+		line := rest
+		pos := bytes.IndexByte(rest, '\n')
+		if pos >= 0 {
+			line = rest[:pos+1]
+		}
+		rest = rest[len(line):]
+
+		switch {
+		case s.lines == 0:
+			s.first = appendMax(s.first, bytes.TrimSuffix(line, []byte("\n")), s.max)
+		case s.inPerf:
+			s.perf = appendMax(s.perf, line, s.max)
+		default:
+			if i := bytes.IndexByte(line, '|'); i >= 0 {
+				s.long = appendMax(s.long, line[:i], s.max)
+				s.perf = appendMax(s.perf, line[i+1:], s.max)
+				s.inPerf = true
+			} else {
+				s.long = appendMax(s.long, line, s.max)
+			}
+		}
+		if pos >= 0 {
+			s.lines++
+		}
+	}
+	return len(p), nil
+}
+
+// String is the output of the plugin with the kept parts
+func (s *nagiosScanner) String() string {
+	output := string(s.first) + "\n" + string(s.long)
+	if s.inPerf {
+		output += "|" + string(s.perf)
+	}
+	return output
+}
+
+func appendMax(dst, p []byte, max int) []byte {
+	if n := max - len(dst); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		dst = append(dst, p[:n]...)
+	}
+	return dst
+}
+
+// parseNagiosOutput splits the plugin output into the first line, the long text
+// and the performance data which can follow a '|' in the first line or in the long text.
+func parseNagiosOutput(output string) nagiosOutput {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	text, firstPerf := splitPerfdata(lines[0])
+	result := nagiosOutput{Text: strings.TrimSpace(text)}
+	perf := []string{firstPerf}
+	var long []string
+	inPerf := false
+
+	for _, line := range lines[1:] {
+		if inPerf {
+			perf = append(perf, line)
+			continue
+		}
+		if pos := strings.Index(line, "|"); pos >= 0 {
+			long = append(long, line[:pos])
+			perf = append(perf, line[pos+1:])
+			inPerf = true
+			continue
+		}
+		long = append(long, line)
+	}
+
+	result.LongText = strings.TrimSpace(strings.Join(long, "\n"))
+	result.Perfdata = parsePerfdata(strings.Join(perf, " "))
+	return result
+}
+
+func splitPerfdata(line string) (string, string) {
+	pos := strings.Index(line, "|")
+	if pos < 0 {
+		return line, ""
+	}
+	return line[:pos], line[pos+1:]
+}
+
+func parsePerfdata(s string) []perfdata {
+	var items []perfdata
+	for _, token := range splitPerfdataTokens(s) {
+		if p, ok := parsePerfdataItem(token); ok {
+			items = append(items, p)
+		}
+	}
+	return items
+}
+
+// splitPerfdataTokens splits on whitespace except inside a quoted label,
+// a quote inside a label is escaped by doubling it.
+func splitPerfdataTokens(s string) []string {
+	var (
+		tokens  []string
+		current []rune
+		quoted  bool
+	)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'' && quoted && i+1 < len(runes) && runes[i+1] == '\'':
+			current = append(current, r, r)
+			i++
+		case r == '\'':
+			quoted = !quoted
+			current = append(current, r)
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if len(current) > 0 {
+				tokens = append(tokens, string(current))
+				current = nil
+			}
+		default:
+			current = append(current, r)
+		}
+	}
+	if len(current) > 0 {
+		tokens = append(tokens, string(current))
+	}
+	return tokens
+}
+
+func parsePerfdataItem(token string) (perfdata, bool) {
+	var p perfdata
+	pos := strings.LastIndex(token, "=")
+	if pos <= 0 {
+		return p, false
+	}
+	p.Label = token[:pos]
+	if len(p.Label) >= 2 && strings.HasPrefix(p.Label, "'") && strings.HasSuffix(p.Label, "'") {
+		p.Label = strings.Replace(p.Label[1:len(p.Label)-1], "''", "'", -1)
+	}
+
+	parts := strings.Split(token[pos+1:], ";")
+	m := perfdataValue.FindStringSubmatch(parts[0])
+	if m == nil {
+		// the value is 'U' if the plugin can't determine it
+		return p, false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return p, false
+	}
+	p.Value = value
+	p.UOM = m[2]
+
+	if len(parts) > 1 {
+		p.Warn = parts[1]
+	}
+	if len(parts) > 2 {
+		p.Crit = parts[2]
+	}
+	if len(parts) > 3 {
+		p.Min = parsePerfdataNumber(parts[3])
+	}
+	if len(parts) > 4 {
+		p.Max = parsePerfdataNumber(parts[4])
+	}
+	return p, true
+}
+
+func parsePerfdataNumber(s string) *float64 {
+	if s == "" {
+		return nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,140 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func Test_parse_nagios_output(t *testing.T) {
+	output := `DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968
+/ 15272 MB (77%);
+/boot 68 MB (69%); | 'boot size'=68MB;88;93;0;98
+/home=69357MB;253404;253409;0;253414 load1=0.01 'it''s'=U`
+
+	parsed := parseNagiosOutput(output)
+	assert.Equal(t, "DISK OK - free space: / 3326 MB (56%);", parsed.Text)
+	assert.Equal(t, "/ 15272 MB (77%);\n/boot 68 MB (69%);", parsed.LongText)
+	if assert.Len(t, parsed.Perfdata, 4) {
+		root := parsed.Perfdata[0]
+		assert.Equal(t, "/", root.Label)
+		assert.Equal(t, 2643.0, root.Value)
+		assert.Equal(t, "MB", root.UOM)
+		assert.Equal(t, "5948", root.Warn)
+		assert.Equal(t, "5958", root.Crit)
+		assert.Equal(t, 0.0, *root.Min)
+		assert.Equal(t, 5968.0, *root.Max)
+
+		assert.Equal(t, "boot size", parsed.Perfdata[1].Label)
+		assert.Equal(t, "/home", parsed.Perfdata[2].Label)
+
+		load := parsed.Perfdata[3]
+		assert.Equal(t, "load1", load.Label)
+		assert.Equal(t, 0.01, load.Value)
+		assert.Equal(t, "", load.UOM)
+		assert.Nil(t, load.Min)
+	}
+}
+
+func Test_nagios_event(t *testing.T) {
+	event := nagiosEvent(&util.Result{Stdout: "LOAD WARNING | load.1=2.5;2;4", ExitCode: 1}, nil)
+
+	assert.Equal(t, common.MapStr{"shell": common.MapStr{
+		"status": Warning,
+		"nagios": common.MapStr{"output": "LOAD WARNING"},
+		"perfdata": common.MapStr{
+			"load_1": common.MapStr{"value": 2.5, "warn": "2", "crit": "4"},
+		},
+	}}, event)
+
+	assert.NoError(t, checkNagios("up")(&util.Result{ExitCode: 1}))
+	assert.Equal(t, errNagiosWarning, checkNagios("down")(&util.Result{ExitCode: 1}))
+	assert.Equal(t, errNagiosCritical, checkNagios("up")(&util.Result{ExitCode: 2}))
+	assert.Equal(t, errNagiosUnknown, checkNagios("up")(&util.Result{ExitCode: 127}))
+}
+
+// nagiosPlugin writes the output of a plugin run like the clients
+type nagiosPlugin struct {
+	stdout   string
+	exitCode int
+}
+
+func (p *nagiosPlugin) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	outputs := util.NewOutputs(req)
+	io.WriteString(outputs.StdoutWriter, p.stdout)
+	result := &util.Result{ExitCode: p.exitCode}
+	outputs.SetResult(result)
+	return result, nil
+}
+
+func Test_nagios_warning(t *testing.T) {
+	config := defaultConfig()
+	config.Check.Mode = nagiosMode
+	config.Check.Request.Command = "check_load"
+	plugin := &nagiosPlugin{"LOAD WARNING - load average: 2.50 | load1=2.5;2;4\n", 1}
+
+	// a warning is reported with its status and perfdata, the monitor is up by default
+	event, err := makeRun(&config, nil, nil, makeValidator(&config))(plugin)
+	assert.NoError(t, err)
+	status, _ := event.GetValue("shell.status")
+	output, _ := event.GetValue("shell.nagios.output")
+	value, _ := event.GetValue("shell.perfdata.load1.value")
+	exitCode, _ := event.GetValue("shell.response.exit_code")
+	assert.Equal(t, Warning, status)
+	assert.Equal(t, "LOAD WARNING - load average: 2.50", output)
+	assert.Equal(t, 2.5, value)
+	assert.Equal(t, 1, exitCode)
+
+	config.Check.Nagios.WarningAs = "down"
+	event, err = makeRun(&config, nil, nil, makeValidator(&config))(plugin)
+	assert.Error(t, err)
+	status, _ = event.GetValue("shell.status")
+	assert.Equal(t, Warning, status)
+
+	config.Check.Nagios.WarningAs = "warn"
+	assert.Error(t, config.Check.Nagios.Validate())
+}
+
+func Test_nagios_truncated(t *testing.T) {
+	stdout := "DISK OK - free space: / 3326 MB | /=2643MB;5948;5958;0;5968\n"
+	for i := 0; i < 100; i++ {
+		stdout += fmt.Sprintf("long output line %d\n", i)
+	}
+	stdout += "end of long output | /boot=68MB;88;93;0;98\n/home=69357MB;253404;253409;0;253414\n"
+
+	config := defaultConfig()
+	config.Check.Mode = nagiosMode
+	config.Check.Request.Command = "check_disk"
+	config.Check.Response.MaxBytes = 64
+	event, err := makeRun(&config, nil, nil, makeValidator(&config))(&nagiosPlugin{stdout, 0})
+	assert.NoError(t, err)
+
+	// the first line and the perfdata are kept from the whole output
+	truncated, _ := event.GetValue("shell.response.truncated")
+	output, _ := event.GetValue("shell.nagios.output")
+	root, _ := event.GetValue("shell.perfdata./.value")
+	home, _ := event.GetValue("shell.perfdata./home.value")
+	assert.Equal(t, true, truncated)
+	assert.Equal(t, "DISK OK - free space: / 3326 MB", output)
+	assert.Equal(t, 2643.0, root)
+	assert.Equal(t, 69357.0, home)
+	perfdata, _ := event.GetValue("shell.perfdata")
+	assert.Len(t, perfdata, 3)
+
+	// the output is scanned the same in chunks
+	scanner := newNagiosScanner(64)
+	for _, c := range stdout {
+		scanner.Write([]byte(string(c)))
+	}
+	whole := newNagiosScanner(64)
+	whole.Write([]byte(stdout))
+	assert.Equal(t, whole.String(), scanner.String())
+	assert.True(t, strings.HasPrefix(scanner.String(), "DISK OK"))
+}
@@ -1,6 +1,9 @@
 package shell
 
 import (
+	"context"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
 
@@ -10,13 +13,21 @@ import (
 const (
 	monitorName = "shell"
 	plainScheme = "shell"
+
+	// sshEndpointPrefix are the docker endpoints reached through ssh, on the default socket
+	// unless the endpoint has another path
+	sshEndpointPrefix   = "ssh://"
+	defaultDockerSocket = "/var/run/docker.sock"
 )
 
 type Client interface {
 	Connect() error
 	Reconnect() error
 	Close()
-	Run(dir, command string, args ...string) (string, error)
+	// RunContext runs the request until it exits, or until the ctx is done
+	RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error)
+	// Run runs the command with the Timeout of the client
+	Run(dir, command string, args ...string) (*util.Result, error)
 }
 
 var debugf = logp.MakeDebug(monitorName)
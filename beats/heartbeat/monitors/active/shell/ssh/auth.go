@@ -0,0 +1,215 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The types of the authentication methods
+const (
+	AuthPassword            = "password"
+	AuthKey                 = "key"
+	AuthAgent               = "agent"
+	AuthKeyboardInteractive = "keyboard_interactive"
+
+	authSockEnv = "SSH_AUTH_SOCK"
+)
+
+// AuthMethod is an authentication method, the methods are tried in the configured order.
+// The ssh protocol tries every method type once, so all the keys and the agent are
+// offered together at the position of the first of them.
+type AuthMethod struct {
+	Type string `config:"type" validate:"required"`
+
+	Password string `config:"password"`
+
+	// Key is the private key or @file, it's decrypted with the Passphrase
+	Key        string `config:"key"`
+	Passphrase string `config:"passphrase"`
+	// Certificate is the OpenSSH certificate of the Key or @file
+	Certificate string `config:"certificate"`
+
+	// ForwardAgent forwards the agent to the remote commands
+	ForwardAgent bool `config:"forward_agent"`
+
+	// Answers are the keyboard interactive responses
+	Answers []Answer `config:"answers"`
+}
+
+// Answer responds to the keyboard interactive questions matching the Prompt regexp
+type Answer struct {
+	Prompt string `config:"prompt" validate:"required"`
+	Answer string `config:"answer"`
+}
+
+func (m *AuthMethod) Validate() error {
+	switch m.Type {
+	case AuthPassword:
+		if m.Password == "" {
+			return fmt.Errorf("The password is required for the password authentication")
+		}
+	case AuthKey:
+		if m.Key == "" {
+			return fmt.Errorf("The key is required for the key authentication")
+		}
+		for _, file := range []string{m.Key, m.Certificate} {
+			if strings.Index(file, "@") == 0 {
+				if _, err := os.Stat(file[1:]); err != nil {
+					return err
+				}
+			}
+		}
+	case AuthAgent:
+	case AuthKeyboardInteractive:
+		for _, answer := range m.Answers {
+			if _, err := regexp.Compile(answer.Prompt); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported authentication type '%v'", m.Type)
+	}
+	return nil
+}
+
+// authMethods returns the configured methods, or the key and password methods without any Auth configured.
+func (c *SSHClient) authMethods() []AuthMethod {
+	if len(c.Auth) > 0 {
+		return c.Auth
+	}
+	var methods []AuthMethod
+	if c.Key != "" {
+		methods = append(methods, AuthMethod{Type: AuthKey, Key: c.Key, Certificate: c.Certificate})
+	}
+	if c.Password != "" {
+		methods = append(methods, AuthMethod{Type: AuthPassword, Password: c.Password})
+	}
+	return methods
+}
+
+// buildAuth returns the ssh authentication methods, the agent connection is kept in c.agentConn
+// until the handshake is done.
+func (c *SSHClient) buildAuth() ([]ssh.AuthMethod, error) {
+	var (
+		auth       []ssh.AuthMethod
+		signers    []ssh.Signer
+		agents     []agent.Agent
+		publicKeys = -1
+	)
+
+	for _, method := range c.authMethods() {
+		switch method.Type {
+		case AuthPassword:
+			auth = append(auth, ssh.Password(method.Password))
+
+		case AuthKey:
+			signer, err := parseKey(method.Key, method.Passphrase)
+			if err != nil {
+				return nil, err
+			}
+			if method.Certificate != "" {
+				// an invalid certificate fails before dialing
+				signer, err = certSigner(signer, method.Certificate, time.Now())
+				if err != nil {
+					return nil, err
+				}
+			}
+			signers = append(signers, signer)
+
+		case AuthAgent:
+			if c.agentConn == nil {
+				conn, err := net.Dial("unix", os.Getenv(authSockEnv))
+				if err != nil {
+					return nil, fmt.Errorf("Failed to connect to the ssh agent: %v", err)
+				}
+				c.agentConn = conn
+			}
+			agents = append(agents, agent.NewClient(c.agentConn))
+
+		case AuthKeyboardInteractive:
+			auth = append(auth, ssh.KeyboardInteractive(keyboardInteractive(method.Answers)))
+		}
+
+		if (method.Type == AuthKey || method.Type == AuthAgent) && publicKeys < 0 {
+			publicKeys = len(auth)
+			auth = append(auth, nil)
+		}
+	}
+
+	if publicKeys >= 0 {
+		auth[publicKeys] = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			all := append([]ssh.Signer{}, signers...)
+			for _, a := range agents {
+				agentSigners, err := a.Signers()
+				if err != nil {
+					return nil, err
+				}
+				all = append(all, agentSigners...)
+			}
+			return all, nil
+		})
+	}
+	return auth, nil
+}
+
+// forwardAgent is true if any agent method forwards the agent
+func (c *SSHClient) forwardAgent() bool {
+	for _, method := range c.authMethods() {
+		if method.Type == AuthAgent && method.ForwardAgent {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SSHClient) closeAgent() {
+	if c.agentConn != nil {
+		c.agentConn.Close()
+		c.agentConn = nil
+	}
+}
+
+// parseKey parses the private key data or @file, an encrypted key requires the passphrase.
+func parseKey(key, passphrase string) (ssh.Signer, error) {
+	data, err := readKeyData(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("The private key is encrypted, a passphrase is required")
+	}
+	return signer, err
+}
+
+// keyboardInteractive answers every question with the first answer whose prompt matches.
+func keyboardInteractive(answers []Answer) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		responses := make([]string, len(questions))
+		for i, question := range questions {
+			found := false
+			for _, answer := range answers {
+				if matched, _ := regexp.MatchString(answer.Prompt, question); matched {
+					responses[i] = answer.Answer
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("No answer for the keyboard interactive prompt '%v'", question)
+			}
+		}
+		return responses, nil
+	}
+}
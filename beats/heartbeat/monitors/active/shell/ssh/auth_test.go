@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptedKey(t *testing.T, passphrase string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte(passphrase), x509.PEMCipherAES256)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(block))
+}
+
+func Test_parse_encrypted_key(t *testing.T) {
+	key := encryptedKey(t, "secret")
+
+	signer, err := parseKey(key, "secret")
+	assert.NoError(t, err)
+	assert.NotNil(t, signer)
+
+	_, err = parseKey(key, "")
+	assert.EqualError(t, err, "The private key is encrypted, a passphrase is required")
+
+	_, err = parseKey(key, "wrong")
+	assert.Error(t, err)
+}
+
+func Test_auth_methods(t *testing.T) {
+	key := encryptedKey(t, "secret")
+
+	comm := NewSSHClient()
+	comm.Password = "password"
+	comm.Key = "not a key"
+	assert.Equal(t, []AuthMethod{
+		{Type: AuthKey, Key: "not a key"},
+		{Type: AuthPassword, Password: "password"},
+	}, comm.authMethods())
+
+	comm.Auth = []AuthMethod{
+		{Type: AuthPassword, Password: "password"},
+		{Type: AuthKey, Key: key, Passphrase: "secret"},
+		{Type: AuthKeyboardInteractive},
+		{Type: AuthKey, Key: key, Passphrase: "secret"},
+	}
+	auth, err := comm.buildAuth()
+	assert.NoError(t, err)
+	// the keys are offered by a single public key method
+	assert.Len(t, auth, 3)
+
+	comm.Auth = []AuthMethod{{Type: AuthKey, Key: key}}
+	_, err = comm.buildAuth()
+	assert.Error(t, err)
+}
+
+func Test_keyboard_interactive(t *testing.T) {
+	challenge := keyboardInteractive([]Answer{
+		{Prompt: "(?i)password", Answer: "secret"},
+		{Prompt: "^Verification code", Answer: "123456"},
+	})
+
+	answers, err := challenge("", "", []string{"Password: ", "Verification code: "}, []bool{false, false})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret", "123456"}, answers)
+
+	_, err = challenge("", "", []string{"Token: "}, []bool{false})
+	assert.Error(t, err)
+}
+
+func Test_auth_method_validate(t *testing.T) {
+	assert.NoError(t, (&AuthMethod{Type: AuthAgent}).Validate())
+	assert.Error(t, (&AuthMethod{Type: AuthPassword}).Validate())
+	assert.Error(t, (&AuthMethod{Type: AuthKey}).Validate())
+	assert.Error(t, (&AuthMethod{Type: "gssapi"}).Validate())
+	assert.Error(t, (&AuthMethod{Type: AuthKeyboardInteractive, Answers: []Answer{{Prompt: "("}}}).Validate())
+}
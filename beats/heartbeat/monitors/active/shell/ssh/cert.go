@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateError is returned if a user or host certificate is expired or not yet valid.
+type CertificateError struct {
+	// Host is empty for the user certificates
+	Host        string
+	KeyID       string
+	ValidAfter  time.Time
+	ValidBefore time.Time
+	Expired     bool
+}
+
+func (e *CertificateError) Error() string {
+	name := fmt.Sprintf("The certificate '%v'", e.KeyID)
+	if e.Host != "" {
+		name = fmt.Sprintf("The host certificate '%v' of %v", e.KeyID, e.Host)
+	}
+	if e.Expired {
+		return fmt.Sprintf("%v expired at %v", name, e.ValidBefore.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%v is not valid before %v", name, e.ValidAfter.Format(time.RFC3339))
+}
+
+// checkValidity returns a CertificateError if the certificate isn't valid at now.
+func checkValidity(cert *ssh.Certificate, host string, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix >= cert.ValidAfter && (cert.ValidBefore == ssh.CertTimeInfinity || unix < cert.ValidBefore) {
+		return nil
+	}
+	err := &CertificateError{
+		Host:       host,
+		KeyID:      cert.KeyId,
+		ValidAfter: time.Unix(int64(cert.ValidAfter), 0),
+		Expired:    unix >= cert.ValidBefore,
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		err.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	return err
+}
+
+// readKeyData returns the data or the content of the @file
+func readKeyData(data string) ([]byte, error) {
+	if strings.Index(data, "@") == 0 {
+		return ioutil.ReadFile(data[1:])
+	}
+	return []byte(data), nil
+}
+
+// certSigner signs in with the certificate of the signer key, the certificate must be valid at now.
+func certSigner(signer ssh.Signer, certificate string, now time.Time) (ssh.Signer, error) {
+	data, err := readKeyData(certificate)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("The certificate is a public key, not a certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("The certificate '%v' is not a user certificate", cert.KeyId)
+	}
+	if err := checkValidity(cert, "", now); err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// parseAuthorities parses the CA public keys, each one is an authorized_keys line or an @file of them.
+func parseAuthorities(keys []string) ([]ssh.PublicKey, error) {
+	var authorities []ssh.PublicKey
+	for _, key := range keys {
+		data, err := readKeyData(key)
+		if err != nil {
+			return nil, err
+		}
+		for len(bytes.TrimSpace(data)) > 0 {
+			pub, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse the host CA key: %v", err)
+			}
+			authorities = append(authorities, pub)
+			data = rest
+		}
+	}
+	return authorities, nil
+}
+
+// hostCertCallback verifies the host certificates against the host CA keys,
+// the plain host keys are verified by the fallback.
+func (c *SSHClient) hostCertCallback(fallback ssh.HostKeyCallback) (ssh.HostKeyCallback, error) {
+	authorities, err := parseAuthorities(c.HostCAKeys)
+	if err != nil {
+		return nil, err
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, authority := range authorities {
+				if bytes.Equal(authority.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: fallback,
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return fallback(hostname, remote, key)
+		}
+		if !checker.IsHostAuthority(cert.SignatureKey, hostname) {
+			return &HostKeyError{Host: hostname, Fingerprint: ssh.FingerprintSHA256(cert.SignatureKey), UnknownCA: true}
+		}
+		if err := checkValidity(cert, hostname, time.Now()); err != nil {
+			return err
+		}
+		return checker.CheckHostKey(hostname, remote, key)
+	}, nil
+}
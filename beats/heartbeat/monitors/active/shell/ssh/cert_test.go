@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoError(t, err)
+	return signer
+}
+
+func newCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, after, before time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:         key,
+		KeyId:       "monitor",
+		CertType:    certType,
+		ValidAfter:  uint64(after.Unix()),
+		ValidBefore: uint64(before.Unix()),
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func Test_cert_signer(t *testing.T) {
+	ca := newSigner(t)
+	signer := newSigner(t)
+	now := time.Now()
+
+	cert := newCert(t, ca, signer.PublicKey(), ssh.UserCert, now.Add(-time.Hour), now.Add(time.Hour))
+	cs, err := certSigner(signer, string(ssh.MarshalAuthorizedKey(cert)), now)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Marshal(), cs.PublicKey().Marshal())
+
+	// the certificate of another key
+	_, err = certSigner(newSigner(t), string(ssh.MarshalAuthorizedKey(cert)), now)
+	assert.Error(t, err)
+
+	_, err = certSigner(signer, string(ssh.MarshalAuthorizedKey(cert)), now.Add(2*time.Hour))
+	if assert.IsType(t, &CertificateError{}, err) {
+		assert.True(t, err.(*CertificateError).Expired)
+	}
+	_, err = certSigner(signer, string(ssh.MarshalAuthorizedKey(cert)), now.Add(-2*time.Hour))
+	if assert.IsType(t, &CertificateError{}, err) {
+		assert.False(t, err.(*CertificateError).Expired)
+	}
+}
+
+func Test_host_cert(t *testing.T) {
+	ca := newSigner(t)
+	host := newSigner(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	now := time.Now()
+
+	comm := NewSSHClient()
+	comm.HostCAKeys = []string{string(ssh.MarshalAuthorizedKey(ca.PublicKey()))}
+	assert.Equal(t, HostKeyStrict, comm.hostKeyPolicy())
+	callback, err := comm.hostKeyCallback()
+	assert.NoError(t, err)
+
+	cert := newCert(t, ca, host.PublicKey(), ssh.HostCert, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, callback("10.0.0.1:22", remote, cert))
+
+	cert = newCert(t, newSigner(t), host.PublicKey(), ssh.HostCert, now.Add(-time.Hour), now.Add(time.Hour))
+	err = callback("10.0.0.1:22", remote, cert)
+	if assert.IsType(t, &HostKeyError{}, err) {
+		assert.True(t, err.(*HostKeyError).UnknownCA)
+	}
+
+	cert = newCert(t, ca, host.PublicKey(), ssh.HostCert, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	err = callback("10.0.0.1:22", remote, cert)
+	if assert.IsType(t, &CertificateError{}, err) {
+		assert.True(t, err.(*CertificateError).Expired)
+	}
+
+	// the plain host keys are verified as before
+	err = callback("10.0.0.1:22", remote, host.PublicKey())
+	assert.IsType(t, &HostKeyError{}, err)
+}
@@ -0,0 +1,196 @@
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// forwards shares the forward of a remote socket between the clients of the same connection
+var forwards = struct {
+	sync.Mutex
+	m map[string]*SocketForward
+}{m: map[string]*SocketForward{}}
+
+// SocketForward serves a local unix socket, each connection is forwarded to a unix socket on the
+// remote host through the shared connection, like `ssh -L local.sock:/var/run/docker.sock`.
+// The local socket supports the deadlines and half closes the channels don't.
+type SocketForward struct {
+	dial     func() (net.Conn, error)
+	dir      string
+	listener net.Listener
+
+	// conns are the forwarded local connections, closed with the forward
+	connsMutex sync.Mutex
+	conns      map[net.Conn]bool
+	closed     bool
+
+	// client is released by the last Close of the forward shared by key
+	client *SSHClient
+	key    string
+	refs   int
+
+	// dialMutex serializes the dials on the client, err is the failure of the last one
+	dialMutex sync.Mutex
+	errMutex  sync.Mutex
+	err       error
+}
+
+// ForwardSocket forwards a local socket to the remote socket, the host is only connected by the
+// first forwarded connection. The forward is shared with the clients of the same connection,
+// every ForwardSocket must be followed by a Close.
+func (c *SSHClient) ForwardSocket(remote string) (*SocketForward, error) {
+	key := c.poolKey() + " " + remote
+	forwards.Lock()
+	defer forwards.Unlock()
+	if f, ok := forwards.m[key]; ok {
+		f.refs++
+		return f, nil
+	}
+	f, err := newSocketForward(func() (net.Conn, error) {
+		return c.DialUnix(remote)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.client, f.key, f.refs = c, key, 1
+	forwards.m[key] = f
+	return f, nil
+}
+
+func newSocketForward(dial func() (net.Conn, error)) (*SocketForward, error) {
+	// the directory is only accessible by the beat
+	dir, err := ioutil.TempDir("", "heartbeat-forward")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "forward.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	f := &SocketForward{dial: dial, dir: dir, listener: listener, conns: map[net.Conn]bool{}}
+	go f.serve()
+	return f, nil
+}
+
+// Path is the path of the local socket
+func (f *SocketForward) Path() string {
+	return f.listener.Addr().String()
+}
+
+// Err is the failure of the last dial of the remote socket, like a host key or certificate error.
+// The local connection is just closed then.
+func (f *SocketForward) Err() error {
+	f.errMutex.Lock()
+	defer f.errMutex.Unlock()
+	return f.err
+}
+
+// Close releases the forward. The last one stops accepting connections and closes the forwarded
+// ones, the ssh connection is released once their channels are closed.
+func (f *SocketForward) Close() {
+	if f.key != "" {
+		forwards.Lock()
+		f.refs--
+		unused := f.refs == 0
+		if unused {
+			delete(forwards.m, f.key)
+		}
+		forwards.Unlock()
+		if !unused {
+			return
+		}
+	}
+	f.listener.Close()
+	os.RemoveAll(f.dir)
+	f.connsMutex.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.connsMutex.Unlock()
+	if f.client != nil {
+		f.client.Close()
+	}
+}
+
+func (f *SocketForward) serve() {
+	for {
+		local, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(local)
+	}
+}
+
+// forward copies both ways until both sides are closed, the local connection is closed at
+// once if the remote socket can't be dialed.
+func (f *SocketForward) forward(local net.Conn) {
+	defer local.Close()
+	if !f.track(local) {
+		return
+	}
+	defer f.untrack(local)
+	f.dialMutex.Lock()
+	remote, err := f.dial()
+	f.dialMutex.Unlock()
+	f.errMutex.Lock()
+	f.err = err
+	f.errMutex.Unlock()
+	if err != nil {
+		logp.Err("Failed to forward %v: %v", f.Path(), err)
+		return
+	}
+	defer remote.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(remote, local)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(local, remote)
+	}()
+	wg.Wait()
+}
+
+// track adds a forwarded connection, false once the forward is closed
+func (f *SocketForward) track(conn net.Conn) bool {
+	f.connsMutex.Lock()
+	defer f.connsMutex.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = true
+	return true
+}
+
+func (f *SocketForward) untrack(conn net.Conn) {
+	f.connsMutex.Lock()
+	defer f.connsMutex.Unlock()
+	delete(f.conns, conn)
+}
+
+// copyHalf copies until EOF and closes the write side of dst, both are closed if it fails.
+func copyHalf(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
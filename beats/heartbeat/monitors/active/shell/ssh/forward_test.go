@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_socket_forward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := net.Listen("unix", filepath.Join(dir, "remote.sock"))
+	assert.NoError(t, err)
+	defer remote.Close()
+	go func() {
+		for {
+			conn, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			// echoes until the half close of the client
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	f, err := newSocketForward(func() (net.Conn, error) {
+		return net.Dial("unix", remote.Addr().String())
+	})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	conn, err := net.Dial("unix", f.Path())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.UnixConn).CloseWrite())
+	out, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(out))
+
+	path := f.Path()
+	f.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_socket_forward_dial_failed(t *testing.T) {
+	f, err := newSocketForward(func() (net.Conn, error) {
+		return nil, errors.New("refused")
+	})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	conn, err := net.Dial("unix", f.Path())
+	assert.NoError(t, err)
+	defer conn.Close()
+	out, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+	assert.EqualError(t, f.Err(), "refused")
+}
+
+func Test_socket_forward_close(t *testing.T) {
+	remote, server := net.Pipe()
+	defer server.Close()
+	f, err := newSocketForward(func() (net.Conn, error) {
+		return remote, nil
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("unix", f.Path())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	assert.NoError(t, err)
+
+	// the forwarded connections are closed with the forward, both ways
+	f.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	server.SetDeadline(time.Now().Add(time.Second))
+	_, err = server.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_socket_forward_shared(t *testing.T) {
+	client := NewSSHClient()
+	client.Addr = "docker.example.com:22"
+	client.Username = "monitor"
+
+	f1, err := client.ForwardSocket("/var/run/docker.sock")
+	assert.NoError(t, err)
+	f2, err := client.ForwardSocket("/var/run/docker.sock")
+	assert.NoError(t, err)
+	assert.True(t, f1 == f2)
+	other, err := client.ForwardSocket("/run/user/1000/docker.sock")
+	assert.NoError(t, err)
+	assert.False(t, f1 == other)
+	other.Close()
+
+	// the socket is removed by the last close
+	f1.Close()
+	_, err = os.Stat(f2.Path())
+	assert.NoError(t, err)
+	f2.Close()
+	_, err = os.Stat(f2.Path())
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, forwards.m)
+}
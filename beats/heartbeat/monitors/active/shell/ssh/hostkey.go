@@ -0,0 +1,162 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The host key policies, an empty policy is strict. The insecure policy must be set explicitly.
+const (
+	HostKeyStrict   = "strict"
+	HostKeyTOFU     = "tofu"
+	HostKeyInsecure = "insecure"
+)
+
+// tofuMutex serializes the writes to the trust on first use state files
+var tofuMutex sync.Mutex
+
+// HostKeyError is returned if the host key is unknown or doesn't match the known key.
+type HostKeyError struct {
+	Host        string
+	Fingerprint string
+	Mismatch    bool
+	// UnknownCA is set if the host certificate isn't signed by a host CA, the Fingerprint is the CA key
+	UnknownCA bool
+}
+
+func (e *HostKeyError) Error() string {
+	if e.UnknownCA {
+		return fmt.Sprintf("The host certificate of %v is signed by the unknown CA %v", e.Host, e.Fingerprint)
+	}
+	if e.Mismatch {
+		return fmt.Sprintf("Host key mismatch for %v, the remote key is %v", e.Host, e.Fingerprint)
+	}
+	return fmt.Sprintf("Unknown host key for %v, the remote key is %v", e.Host, e.Fingerprint)
+}
+
+func (c *SSHClient) hostKeyPolicy() string {
+	if c.HostKeyPolicy != "" {
+		return c.HostKeyPolicy
+	}
+	return HostKeyStrict
+}
+
+// knownHosts is the KnownHosts file, or the ~/.ssh/known_hosts of the user running the beat like
+// OpenSSH. It's empty if there's none.
+func (c *SSHClient) knownHosts() string {
+	if c.KnownHosts != "" {
+		return c.KnownHosts
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+	if home == "" {
+		return ""
+	}
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// hostKeyCallback verifies the host certificates against the host CA keys, and the host keys against
+// the pinned fingerprints first, then against the known hosts.
+// With trust on first use, the key of an unknown host is added to the state file.
+func (c *SSHClient) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	policy := c.hostKeyPolicy()
+	if policy == HostKeyInsecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	var files []string
+	if knownHosts := c.knownHosts(); knownHosts != "" {
+		files = append(files, knownHosts)
+	}
+	if policy == HostKeyTOFU {
+		// knownhosts fails on missing files
+		f, err := os.OpenFile(c.TOFUStateFile, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		files = append(files, c.TOFUStateFile)
+	}
+
+	var known ssh.HostKeyCallback
+	if len(files) > 0 {
+		var err error
+		known, err = knownhosts.New(files...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if pins := c.fingerprints(hostname); len(pins) > 0 {
+			for _, pin := range pins {
+				if pin == fingerprint {
+					return nil
+				}
+			}
+			return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Mismatch: true}
+		}
+
+		if known != nil {
+			err := known(hostname, remote, key)
+			keyErr, ok := err.(*knownhosts.KeyError)
+			if !ok {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Mismatch: true}
+			}
+		}
+
+		if policy == HostKeyTOFU {
+			return c.trustHostKey(hostname, key)
+		}
+		return &HostKeyError{Host: hostname, Fingerprint: fingerprint}
+	}
+	if len(c.HostCAKeys) > 0 {
+		return c.hostCertCallback(callback)
+	}
+	return callback, nil
+}
+
+// fingerprints returns the pinned fingerprints of host:port, or of the host without port.
+func (c *SSHClient) fingerprints(hostname string) []string {
+	if pins, ok := c.HostKeyFingerprints[hostname]; ok {
+		return pins
+	}
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return c.HostKeyFingerprints[host]
+	}
+	return nil
+}
+
+func (c *SSHClient) trustHostKey(hostname string, key ssh.PublicKey) error {
+	tofuMutex.Lock()
+	defer tofuMutex.Unlock()
+
+	f, err := os.OpenFile(c.TOFUStateFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
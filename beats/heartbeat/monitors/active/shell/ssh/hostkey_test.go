@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return key
+}
+
+func Test_host_key_fingerprints(t *testing.T) {
+	key := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	comm := NewSSHClient()
+	comm.HostKeyFingerprints = map[string][]string{"10.0.0.1": {ssh.FingerprintSHA256(key)}}
+	callback, err := comm.hostKeyCallback()
+	assert.NoError(t, err)
+
+	assert.NoError(t, callback("10.0.0.1:22", remote, key))
+	err = callback("10.0.0.1:22", remote, newHostKey(t))
+	if assert.IsType(t, &HostKeyError{}, err) {
+		assert.True(t, err.(*HostKeyError).Mismatch)
+	}
+	err = callback("10.0.0.2:22", remote, key)
+	if assert.IsType(t, &HostKeyError{}, err) {
+		assert.False(t, err.(*HostKeyError).Mismatch)
+	}
+}
+
+func Test_host_key_known_hosts(t *testing.T) {
+	key := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+
+	dir, err := ioutil.TempDir("", "known_hosts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("10.0.0.1:2222")}, key)
+	assert.NoError(t, ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	comm := NewSSHClient()
+	comm.KnownHosts = knownHosts
+	callback, err := comm.hostKeyCallback()
+	assert.NoError(t, err)
+
+	assert.NoError(t, callback("10.0.0.1:2222", remote, key))
+	err = callback("10.0.0.1:2222", remote, newHostKey(t))
+	if assert.IsType(t, &HostKeyError{}, err) {
+		assert.True(t, err.(*HostKeyError).Mismatch)
+	}
+}
+
+func Test_host_key_tofu(t *testing.T) {
+	key := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	dir, err := ioutil.TempDir("", "tofu")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	comm := NewSSHClient()
+	comm.HostKeyPolicy = HostKeyTOFU
+	comm.TOFUStateFile = filepath.Join(dir, "state")
+	callback, err := comm.hostKeyCallback()
+	assert.NoError(t, err)
+	assert.NoError(t, callback("10.0.0.1:22", remote, key))
+
+	// the key is known by the next connection
+	callback, err = comm.hostKeyCallback()
+	assert.NoError(t, err)
+	assert.NoError(t, callback("10.0.0.1:22", remote, key))
+	err = callback("10.0.0.1:22", remote, newHostKey(t))
+	if assert.IsType(t, &HostKeyError{}, err) {
+		assert.True(t, err.(*HostKeyError).Mismatch)
+	}
+}
+
+func Test_host_key_strict_by_default(t *testing.T) {
+	comm := NewSSHClient()
+	assert.Equal(t, HostKeyStrict, comm.hostKeyPolicy())
+
+	// the known_hosts of the user are used without known_hosts setting
+	key := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	home, err := ioutil.TempDir("", "home")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	callback, err := comm.hostKeyCallback()
+	assert.NoError(t, err)
+	assert.IsType(t, &HostKeyError{}, callback("10.0.0.1:22", remote, key))
+
+	assert.NoError(t, os.Mkdir(filepath.Join(home, ".ssh"), 0700))
+	line := knownhosts.Line([]string{knownhosts.Normalize("10.0.0.1:22")}, key)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line+"\n"), 0600))
+	callback, err = comm.hostKeyCallback()
+	assert.NoError(t, err)
+	assert.NoError(t, callback("10.0.0.1:22", remote, key))
+}
@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errTunnelTimeout = errors.New("The connection through the proxy jump timed out")
+
+// connectJumps connects to the jump hosts in order, each through the previous one.
+func (c *SSHClient) connectJumps(ctx context.Context) ([]*ssh.Client, error) {
+	var jumps []*ssh.Client
+	var jump *ssh.Client
+	for _, hop := range c.ProxyJump {
+		client, _, err := hop.connectVia(ctx, jump)
+		if err != nil {
+			closeClients(jumps)
+			switch err.(type) {
+			case *HostKeyError, *CertificateError:
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to connect to the proxy jump %v: %v", hop.Addr, err)
+		}
+		jumps = append(jumps, client)
+		jump = client
+	}
+	return jumps, nil
+}
+
+// closeClients closes the jump hosts from the last one
+func closeClients(jumps []*ssh.Client) {
+	for i := len(jumps) - 1; i >= 0; i-- {
+		jumps[i].Close()
+	}
+}
+
+// dialVia opens a direct-tcpip channel to addr through the jump client, or a tcp connection
+// without it, until the ctx is done.
+func dialVia(ctx context.Context, jump *ssh.Client, addr string) (net.Conn, error) {
+	if jump == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := jump.Dial("tcp", addr)
+		result <- dialed{conn, err}
+	}()
+	select {
+	case d := <-result:
+		if d.err != nil {
+			return nil, d.err
+		}
+		return &tunnelConn{Conn: d.conn}, nil
+	case <-ctx.Done():
+		// the opening of the channel can't be cancelled, it's closed once it's opened
+		go func() {
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// tunnelConn adds the deadlines of the handshake to a direct-tcpip channel, which doesn't
+// support them, by closing the channel once a deadline expires.
+type tunnelConn struct {
+	net.Conn
+	mutex      sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    int32
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+		err = errTunnelTimeout
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+		err = errTunnelTimeout
+	}
+	return n, err
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.setTimer(&c.readTimer, t)
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+func (c *tunnelConn) setTimer(timer **time.Timer, t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+}
+
+func (c *tunnelConn) expire() {
+	atomic.StoreInt32(&c.expired, 1)
+	c.Conn.Close()
+}
+
+func (c *tunnelConn) Close() error {
+	c.SetDeadline(time.Time{})
+	return c.Conn.Close()
+}
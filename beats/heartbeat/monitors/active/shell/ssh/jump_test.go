@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
+)
+
+// serveJump runs a jump host without authentication, which forwards the direct-tcpip channels
+func serveJump(t *testing.T, listener net.Listener) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newSigner(t))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				var target struct {
+					Host       string
+					Port       uint32
+					OriginHost string
+					OriginPort uint32
+				}
+				if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+					newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+					continue
+				}
+				remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+				if err != nil {
+					newChannel.Reject(ssh.ConnectionFailed, err.Error())
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					remote.Close()
+					continue
+				}
+				go ssh.DiscardRequests(requests)
+				go func() {
+					io.Copy(channel, remote)
+					channel.Close()
+				}()
+				go func() {
+					io.Copy(remote, channel)
+					remote.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func newJumpClient(t *testing.T, addr string) (client *SSHClient, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go serveJump(t, listener)
+
+	jump := NewSSHClient()
+	jump.Addr = listener.Addr().String()
+	jump.Username = "jump"
+	jump.Password = "secret"
+	jump.HostKeyPolicy = HostKeyInsecure
+	jump.Timeout = 100 * time.Millisecond
+
+	client = NewSSHClient()
+	client.Addr = addr
+	client.Username = "monitor"
+	client.Password = "secret"
+	client.HostKeyPolicy = HostKeyInsecure
+	client.Timeout = 100 * time.Millisecond
+	client.ProxyJump = []*SSHClient{jump}
+	return client, func() { listener.Close() }
+}
+
+func Test_proxy_jump_timeout(t *testing.T) {
+	// the host behind the jump host never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client, stop := newJumpClient(t, silent.Addr().String())
+	defer stop()
+
+	// the deadline of the handshake through the tunnel expires after the Timeout
+	start := time.Now()
+	_, _, _, err = client.dial(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errTunnelTimeout.Error())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func Test_proxy_jump_idle(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go serveExec(t, listener)
+	client, stop := newJumpClient(t, listener.Addr().String())
+	defer stop()
+
+	result, err := client.RunContext(context.Background(), &util.RunRequest{Command: "echo", Args: []string{"ok"}})
+	require.NoError(t, err)
+	assert.Equal(t, "echo ok", result.Stdout)
+	assert.True(t, result.Timings.Handshake > 0)
+
+	// the deadlines of the handshake are cleared, the idle tunnel outlives the Timeout
+	time.Sleep(300 * time.Millisecond)
+	result, err = client.RunContext(context.Background(), &util.RunRequest{Command: "echo", Args: []string{"ok"}})
+	require.NoError(t, err)
+	assert.Equal(t, "echo ok", result.Stdout)
+	assert.Equal(t, time.Duration(0), result.Timings.Handshake)
+}
+
+func Test_handshake_clears_deadline(t *testing.T) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newSigner(t))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client, err := handshake(ctx, conn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            "monitor",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the idle connection outlives the timeout of the handshake
+	time.Sleep(150 * time.Millisecond)
+	_, _, err = client.SendRequest(keepaliveRequest, true, nil)
+	assert.NoError(t, err)
+}
+
+func Test_handshake_cancelled(t *testing.T) {
+	// the server never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = handshake(ctx, conn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            "monitor",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
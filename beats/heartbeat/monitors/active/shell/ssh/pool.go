@@ -0,0 +1,350 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The pool defaults, OpenSSH allows 10 sessions by connection
+const (
+	DefaultMaxSessions        = 10
+	DefaultIdleTimeout        = 5 * time.Minute
+	DefaultKeepaliveInterval  = 3 * time.Second
+	DefaultKeepaliveMaxMissed = 3
+
+	evictInterval    = 10 * time.Second
+	keepaliveRequest = "keepalive@epicon.com"
+)
+
+var (
+	errConnClosed   = errors.New("The shared ssh connection is closed")
+	errSessionsBusy = errors.New("Timed out waiting for a free session on the shared ssh connection")
+)
+
+// connPool shares the connections of all clients with the same address, user and credentials
+var connPool = newPool()
+
+type pool struct {
+	mutex sync.Mutex
+	conns map[string]*conn
+	evict sync.Once
+}
+
+// connOptions are the settings of a pooled connection, taken from the client dialing it.
+type connOptions struct {
+	// maxSessions limits the concurrent sessions, 0 is unlimited
+	maxSessions int
+	// idleTimeout closes the connection unused for this time, 0 closes it once no client uses it
+	idleTimeout time.Duration
+	// a keepalive is sent every keepaliveInterval, the connection is closed after keepaliveMaxMissed
+	// keepalives without reply. 0 disables the keepalives.
+	keepaliveInterval  time.Duration
+	keepaliveMaxMissed int
+}
+
+// conn is a pooled connection, with the jump hosts it's tunneled through.
+type conn struct {
+	pool     *pool
+	key      string
+	opts     connOptions
+	ready    chan struct{}
+	done     chan struct{}
+	err      error
+	client   *ssh.Client
+	jumps    []*ssh.Client
+	sessions chan struct{}
+	refs     int
+	active   int
+	lastUsed time.Time
+	closed   bool
+}
+
+func newPool() *pool {
+	return &pool{conns: map[string]*conn{}}
+}
+
+// get returns the connection of the key, the first caller dials it while the others wait until
+// their ctx is done. Every successful get must be followed by a put once the session or channel
+// is closed, the clients only hold the connection while they use it.
+func (p *pool) get(ctx context.Context, key string, opts connOptions, dial func() (*ssh.Client, []*ssh.Client, error)) (*conn, error) {
+	p.mutex.Lock()
+	if c, ok := p.conns[key]; ok {
+		c.refs++
+		p.mutex.Unlock()
+		select {
+		case <-c.ready:
+		case <-ctx.Done():
+			c.put()
+			return nil, ctx.Err()
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c, nil
+	}
+	c := &conn{
+		pool:     p,
+		key:      key,
+		opts:     opts,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		refs:     1,
+		lastUsed: time.Now(),
+	}
+	if opts.maxSessions > 0 {
+		c.sessions = make(chan struct{}, opts.maxSessions)
+	}
+	p.conns[key] = c
+	p.mutex.Unlock()
+	p.evict.Do(func() { go p.evictIdle() })
+
+	client, jumps, err := dial()
+	p.mutex.Lock()
+	c.client, c.jumps, c.err = client, jumps, err
+	p.mutex.Unlock()
+	close(c.ready)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	if client != nil {
+		// the connection is only closed once it's dead, not by the failed commands of a client
+		go func() {
+			client.Wait()
+			c.close()
+		}()
+	}
+	if client != nil && opts.keepaliveInterval > 0 {
+		go c.keepalive(func() error {
+			_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+			return err
+		})
+	}
+	return c, nil
+}
+
+// put releases the connection got from the pool. The unused connection is kept for the next
+// runs until it's evicted, or closed at once without idle timeout.
+func (c *conn) put() {
+	c.pool.mutex.Lock()
+	c.refs--
+	c.lastUsed = time.Now()
+	unused := c.refs == 0 && c.opts.idleTimeout == 0
+	c.pool.mutex.Unlock()
+	if unused {
+		c.close()
+	}
+}
+
+// evictIdle closes the connections unused for longer than their idle timeout, like the
+// connections of the removed monitors.
+func (p *pool) evictIdle() {
+	t := time.NewTicker(evictInterval)
+	defer t.Stop()
+	for now := range t.C {
+		p.closeIdle(now)
+	}
+}
+
+func (p *pool) closeIdle(now time.Time) {
+	p.mutex.Lock()
+	var idle []*conn
+	for _, c := range p.conns {
+		if c.refs == 0 && c.active == 0 && now.Sub(c.lastUsed) > c.opts.idleTimeout {
+			idle = append(idle, c)
+		}
+	}
+	p.mutex.Unlock()
+	for _, c := range idle {
+		c.close()
+	}
+}
+
+// keepalive sends a keepalive every interval until the connection is closed. The connection is
+// dead and closed once the keepalives are missed, or fail, max missed times in a row.
+func (c *conn) keepalive(send func() error) {
+	t := time.NewTicker(c.opts.keepaliveInterval)
+	defer t.Stop()
+	// the reply of a missed keepalive may still arrive, only one is pending at a time
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case err := <-replies:
+			pending = false
+			if err != nil {
+				c.close()
+				return
+			}
+			missed = 0
+		case <-t.C:
+			if pending {
+				missed++
+				if c.opts.keepaliveMaxMissed > 0 && missed >= c.opts.keepaliveMaxMissed {
+					c.close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() { replies <- send() }()
+		}
+	}
+}
+
+// acquire waits up to timeout for a free session, or until the ctx is done. The connection must
+// not be closed.
+func (c *conn) acquire(ctx context.Context, timeout time.Duration) error {
+	if c.sessions != nil {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case c.sessions <- struct{}{}:
+		case <-expired:
+			return errSessionsBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := c.use(); err != nil {
+		if c.sessions != nil {
+			<-c.sessions
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *conn) release() {
+	c.unuse()
+	if c.sessions != nil {
+		<-c.sessions
+	}
+}
+
+// use marks the connection as used by a session or a channel, it isn't evicted until unuse.
+func (c *conn) use() error {
+	c.pool.mutex.Lock()
+	defer c.pool.mutex.Unlock()
+	if c.closed {
+		return errConnClosed
+	}
+	c.active++
+	return nil
+}
+
+func (c *conn) unuse() {
+	c.pool.mutex.Lock()
+	c.active--
+	c.lastUsed = time.Now()
+	c.pool.mutex.Unlock()
+}
+
+// newSession opens a session once there's a free one, release must be called after closing it.
+// The connection is closed if it fails, not if the session is refused by the host.
+func (c *conn) newSession(ctx context.Context, timeout time.Duration) (*ssh.Session, error) {
+	if err := c.acquire(ctx, timeout); err != nil {
+		return nil, err
+	}
+	session, err := c.client.NewSession()
+	if err != nil {
+		c.release()
+		if _, refused := err.(*ssh.OpenChannelError); !refused {
+			c.close()
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// dial opens a channel to the address on the remote host, like a unix socket. The channels
+// aren't sessions and don't wait for a free one, but the connection isn't evicted until they're
+// closed. The connection is closed if it fails, not if the address is refused by the host.
+func (c *conn) dial(network, addr string) (net.Conn, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+	channel, err := c.client.Dial(network, addr)
+	if err != nil {
+		c.unuse()
+		if _, refused := err.(*ssh.OpenChannelError); !refused {
+			c.close()
+		}
+		return nil, err
+	}
+	return &channelConn{Conn: channel, unuse: c.unuse}, nil
+}
+
+// channelConn releases the connection once the channel is closed
+type channelConn struct {
+	net.Conn
+	once  sync.Once
+	unuse func()
+}
+
+func (c *channelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.unuse)
+	return err
+}
+
+// CloseWrite sends EOF to the remote end, like the write side of a half closed socket
+func (c *channelConn) CloseWrite() error {
+	if channel, ok := c.Conn.(closeWriter); ok {
+		return channel.CloseWrite()
+	}
+	return nil
+}
+
+// close removes the connection from the pool and closes it with its jump hosts
+func (c *conn) close() {
+	c.pool.mutex.Lock()
+	if c.closed {
+		c.pool.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	if c.pool.conns[c.key] == c {
+		delete(c.pool.conns, c.key)
+	}
+	c.pool.mutex.Unlock()
+
+	// stops the keepalive
+	close(c.done)
+
+	if c.client != nil {
+		c.client.Close()
+	}
+	closeClients(c.jumps)
+}
+
+// poolKey identifies the connections which can be shared, by the address, the user and
+// a fingerprint of the credentials, the host key settings and the jump hosts.
+func (c *SSHClient) poolKey() string {
+	return fmt.Sprintf("%v@%v/%x", c.Username, c.Addr, sha256.Sum256([]byte(c.credentials())))
+}
+
+func (c *SSHClient) credentials() string {
+	s := fmt.Sprintf("%q %q %q %+v %q %q %q %v %v",
+		c.Password, c.Key, c.Certificate, c.Auth,
+		c.HostKeyPolicy, c.KnownHosts, c.TOFUStateFile, c.HostKeyFingerprints, c.HostCAKeys)
+	for _, hop := range c.ProxyJump {
+		s += " " + hop.poolKey()
+	}
+	return s
+}
@@ -0,0 +1,229 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_pool_shares_connections(t *testing.T) {
+	p := newPool()
+	dials := 0
+	dial := func() (*ssh.Client, []*ssh.Client, error) {
+		dials++
+		return nil, nil, nil
+	}
+
+	opts := connOptions{maxSessions: 2, idleTimeout: time.Minute}
+	c1, err := p.get(context.Background(), "key", opts, dial)
+	assert.NoError(t, err)
+	c2, err := p.get(context.Background(), "key", opts, dial)
+	assert.NoError(t, err)
+	assert.True(t, c1 == c2)
+	assert.Equal(t, 1, dials)
+
+	// a closed connection is dialed again
+	c1.close()
+	c3, err := p.get(context.Background(), "key", opts, dial)
+	assert.NoError(t, err)
+	assert.False(t, c1 == c3)
+	assert.Equal(t, 2, dials)
+
+	// failed dials aren't pooled
+	failed := errors.New("failed")
+	_, err = p.get(context.Background(), "other", opts, func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, failed })
+	assert.Equal(t, failed, err)
+	assert.Len(t, p.conns, 1)
+}
+
+func Test_pool_max_sessions(t *testing.T) {
+	p := newPool()
+	c, err := p.get(context.Background(), "key", connOptions{maxSessions: 2}, func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil })
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	assert.Equal(t, errSessionsBusy, c.acquire(context.Background(), 10*time.Millisecond))
+
+	c.release()
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	c.release()
+	c.release()
+
+	// a cancelled check doesn't wait for a free session
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	assert.Equal(t, context.Canceled, c.acquire(ctx, time.Minute))
+	c.release()
+	c.release()
+
+	c.close()
+	assert.Equal(t, errConnClosed, c.acquire(context.Background(), 10*time.Millisecond))
+	assert.Equal(t, 0, c.active)
+}
+
+func Test_pool_get_cancelled(t *testing.T) {
+	p := newPool()
+	dialing := make(chan struct{})
+	dialed := make(chan struct{})
+	go p.get(context.Background(), "key", connOptions{idleTimeout: time.Minute}, func() (*ssh.Client, []*ssh.Client, error) {
+		close(dialing)
+		<-dialed
+		return nil, nil, nil
+	})
+	<-dialing
+
+	// the other clients stop waiting for the dial once their ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p.get(ctx, "key", connOptions{}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(dialed)
+	p.mutex.Lock()
+	assert.Equal(t, 1, p.conns["key"].refs)
+	p.mutex.Unlock()
+}
+
+func Test_pool_channels(t *testing.T) {
+	p := newPool()
+	c, err := p.get(context.Background(), "key", connOptions{maxSessions: 1}, func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil })
+	assert.NoError(t, err)
+
+	// a channel keeps the connection active without taking a session
+	assert.NoError(t, c.use())
+	local, remote := net.Pipe()
+	defer remote.Close()
+	channel := &channelConn{Conn: local, unuse: c.unuse}
+	assert.NoError(t, c.acquire(context.Background(), 10*time.Millisecond))
+	c.release()
+	assert.Equal(t, 1, c.active)
+	channel.Close()
+	channel.Close()
+	assert.Equal(t, 0, c.active)
+
+	c.close()
+	_, err = c.dial("unix", "/var/run/docker.sock")
+	assert.Equal(t, errConnClosed, err)
+}
+
+func Test_reconnect_keeps_shared_connection(t *testing.T) {
+	dial := func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil }
+	client := NewSSHClient()
+	client.Addr = "127.0.0.1:1"
+	client.Username = "monitor"
+	client.Password = "secret"
+	client.HostKeyPolicy = HostKeyInsecure
+	client.Timeout = time.Second
+	shared, err := connPool.get(context.Background(), client.poolKey(), connOptions{}, dial)
+	assert.NoError(t, err)
+	defer shared.put()
+
+	// the connection of the other client is reused, the client doesn't hold it
+	assert.NoError(t, client.Reconnect())
+	assert.False(t, shared.closed)
+	assert.Equal(t, 1, shared.refs)
+}
+
+func Test_pool_idle(t *testing.T) {
+	p := newPool()
+	dial := func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil }
+
+	// the unused connection is kept for the next runs until it's idle
+	c, err := p.get(context.Background(), "key", connOptions{idleTimeout: time.Minute}, dial)
+	assert.NoError(t, err)
+	c.put()
+	assert.False(t, c.closed)
+	p.closeIdle(time.Now())
+	assert.False(t, c.closed)
+	p.closeIdle(time.Now().Add(2 * time.Minute))
+	assert.True(t, c.closed)
+	assert.Len(t, p.conns, 0)
+
+	// a used connection isn't evicted
+	c, err = p.get(context.Background(), "key", connOptions{idleTimeout: time.Minute}, dial)
+	assert.NoError(t, err)
+	p.closeIdle(time.Now().Add(2 * time.Minute))
+	assert.False(t, c.closed)
+	c.close()
+
+	// without idle timeout it's closed once unused
+	c, err = p.get(context.Background(), "key", connOptions{}, dial)
+	assert.NoError(t, err)
+	c.put()
+	assert.True(t, c.closed)
+}
+
+func Test_pool_key(t *testing.T) {
+	c1 := NewSSHClient()
+	c1.Addr = "10.0.0.1:22"
+	c1.Username = "root"
+	c1.Password = "secret"
+	c2 := NewSSHClient()
+	c2.Addr = "10.0.0.1:22"
+	c2.Username = "root"
+	c2.Password = "secret"
+	assert.Equal(t, c1.poolKey(), c2.poolKey())
+
+	c2.Password = "other"
+	assert.NotEqual(t, c1.poolKey(), c2.poolKey())
+	assert.NotContains(t, c1.poolKey(), "secret")
+
+	c2.Password = "secret"
+	c2.ProxyJump = []*SSHClient{NewSSHClient()}
+	assert.NotEqual(t, c1.poolKey(), c2.poolKey())
+}
+
+func Test_pool_keepalive(t *testing.T) {
+	p := newPool()
+	c, err := p.get(context.Background(), "key", connOptions{}, func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil })
+	assert.NoError(t, err)
+	c.opts.keepaliveInterval = 5 * time.Millisecond
+	c.opts.keepaliveMaxMissed = 2
+
+	// the replies never arrive
+	blocked := make(chan struct{})
+	defer close(blocked)
+	done := make(chan struct{})
+	go func() {
+		c.keepalive(func() error {
+			<-blocked
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the keepalive didn't close the connection")
+	}
+	assert.Equal(t, errConnClosed, c.acquire(context.Background(), 0))
+	assert.Len(t, p.conns, 0)
+}
+
+func Test_pool_keepalive_stops_on_close(t *testing.T) {
+	p := newPool()
+	c, err := p.get(context.Background(), "key", connOptions{keepaliveInterval: time.Millisecond, keepaliveMaxMissed: 3}, func() (*ssh.Client, []*ssh.Client, error) { return nil, nil, nil })
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		c.keepalive(func() error { return nil })
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.put()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the keepalive didn't stop")
+	}
+}
@@ -2,9 +2,10 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -12,173 +13,405 @@ import (
 	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type SSHClient struct {
-	sshclient  *ssh.Client
 	sshError   error
+	agentConn  net.Conn
 	initClient *sync.Once
 
 	Addr     string
 	Username string
 	Password string
 	Key      string
-	Timeout  time.Duration
-}
+	// Certificate is the OpenSSH certificate of the Key or @file
+	Certificate string
+	Timeout     time.Duration
+	// Shell runs the command as a raw shell snippet, otherwise it's quoted like the args
+	Shell bool
+	// Env is set on the sessions, or exported by the command if the server doesn't accept it
+	Env map[string]string
 
-type TimeoutConn struct {
-	net.Conn
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-}
+	// Auth are the authentication methods in order, Password and Key are used without them
+	Auth []AuthMethod
 
-func (c *TimeoutConn) Read(b []byte) (int, error) {
-	err := c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-	if err != nil {
-		return 0, err
-	}
-	return c.Conn.Read(b)
-}
+	// ProxyJump are the jump hosts in order, the connection to Addr is tunneled through all of them
+	ProxyJump []*SSHClient
 
-func (c *TimeoutConn) Write(b []byte) (int, error) {
-	err := c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-	if err != nil {
-		return 0, err
-	}
-	return c.Conn.Write(b)
+	// HostKeyPolicy is HostKeyStrict, HostKeyTOFU or HostKeyInsecure
+	HostKeyPolicy string
+	// KnownHosts is a known_hosts file
+	KnownHosts string
+	// HostKeyFingerprints are the pinned SHA256 fingerprints by host or host:port
+	HostKeyFingerprints map[string][]string
+	// TOFUStateFile keeps the host keys trusted on first use
+	TOFUStateFile string
+	// HostCAKeys are the CA public keys or @files signing the host certificates
+	HostCAKeys []string
+
+	// The connection is shared by the clients with the same address, user and credentials.
+	// MaxSessions limits its concurrent sessions, it's closed once unused for IdleTimeout, at
+	// once without it.
+	MaxSessions int
+	IdleTimeout time.Duration
+
+	// KeepaliveInterval is the interval of the keepalives, 0 disables them. The connection is
+	// closed after KeepaliveMaxMissed keepalives without reply.
+	KeepaliveInterval  time.Duration
+	KeepaliveMaxMissed int
 }
 
 func NewSSHClient() *SSHClient {
 	return &SSHClient{
-		initClient: &sync.Once{},
+		initClient:         &sync.Once{},
+		Shell:              true,
+		MaxSessions:        DefaultMaxSessions,
+		IdleTimeout:        DefaultIdleTimeout,
+		KeepaliveInterval:  DefaultKeepaliveInterval,
+		KeepaliveMaxMissed: DefaultKeepaliveMaxMissed,
 	}
 }
 
-func (c *SSHClient) buildSSHConfig() (*ssh.ClientConfig, error) {
+// buildSSHConfig builds the config of a handshake, the host key error is kept in hostKeyErr as
+// the handshake only returns its message.
+func (c *SSHClient) buildSSHConfig(hostKeyErr *error) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
 	sshConfig := &ssh.ClientConfig{
-		User:            c.Username,
-		Timeout:         c.Timeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	if c.Password != "" {
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.Password(c.Password)}
-	}
-	if c.Key != "" {
-		var data []byte
-		var err error
-		if strings.Index(c.Key, "@") == 0 {
-			data, err = ioutil.ReadFile(string(c.Key[1:]))
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			data = []byte(c.Key)
-		}
-
-		signer, err := ssh.ParsePrivateKey(data)
-		if err != nil {
-			return nil, err
-		}
-
-		sshConfig.Auth = []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		}
+		User:    c.Username,
+		Timeout: c.Timeout,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			*hostKeyErr = hostKeyCallback(hostname, remote, key)
+			return *hostKeyErr
+		},
+	}
+	sshConfig.Auth, err = c.buildAuth()
+	if err != nil {
+		return nil, err
 	}
 	return sshConfig, nil
 }
 
+// Reconnect checks the connection again. The shared connection is only closed by the pool once
+// it's dead, the sessions of the other clients keep running, and a new one is dialed.
 func (c *SSHClient) Reconnect() error {
-	fmt.Println("reconnect")
 	c.initClient = &sync.Once{}
 	return c.Connect()
 }
 
+// Connect checks that the connection can be opened, it's kept in the pool for the runs.
 func (c *SSHClient) Connect() error {
 
 	c.initClient.Do(func() {
+		var conn *conn
+		conn, _, c.sshError = c.get(context.Background())
+		if c.sshError == nil {
+			conn.put()
+		}
+	})
+	return c.sshError
+}
 
-		sshConfig, err := c.buildSSHConfig()
-		if err != nil {
-			c.sshError = err
-			return
+// get gets the shared connection from the pool, it's dialed if there's none. The timings are
+// the connect and handshake of the connection dialed by this call, 0 for a pooled one.
+func (c *SSHClient) get(ctx context.Context) (*conn, util.Timings, error) {
+	var timings util.Timings
+	conn, err := connPool.get(ctx, c.poolKey(), connOptions{
+		maxSessions:        c.MaxSessions,
+		idleTimeout:        c.IdleTimeout,
+		keepaliveInterval:  c.KeepaliveInterval,
+		keepaliveMaxMissed: c.KeepaliveMaxMissed,
+	}, func() (client *ssh.Client, jumps []*ssh.Client, err error) {
+		client, jumps, timings, err = c.dial(ctx)
+		return client, jumps, err
+	})
+	return conn, timings, err
+}
+
+// dial connects to Addr through the jump hosts for the pool, the connections to the jump
+// hosts are part of the connect timing.
+func (c *SSHClient) dial(ctx context.Context) (*ssh.Client, []*ssh.Client, util.Timings, error) {
+	start := time.Now()
+	jumps, err := c.connectJumps(ctx)
+	if err != nil {
+		return nil, nil, util.Timings{}, err
+	}
+	jumpsConnect := time.Since(start)
+	var jump *ssh.Client
+	if len(jumps) > 0 {
+		jump = jumps[len(jumps)-1]
+	}
+	client, timings, err := c.connectVia(ctx, jump)
+	timings.Connect += jumpsConnect
+	if err != nil {
+		closeClients(jumps)
+		return nil, nil, timings, err
+	}
+	if c.forwardAgent() {
+		if err := agent.ForwardToRemote(client, os.Getenv(authSockEnv)); err != nil {
+			client.Close()
+			closeClients(jumps)
+			return nil, nil, timings, err
 		}
-		conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
-		if err != nil {
-			c.sshError = err
-			return
+	}
+	return client, jumps, timings, nil
+}
+
+// connectVia does the handshake with Addr through the jump client, or directly without it. The
+// dial and the handshake are limited by the Timeout, and stopped once the ctx is done.
+func (c *SSHClient) connectVia(ctx context.Context, jump *ssh.Client) (*ssh.Client, util.Timings, error) {
+	var timings util.Timings
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	// the agent is only needed by the handshake
+	defer c.closeAgent()
+	var hostKeyErr error
+	sshConfig, err := c.buildSSHConfig(&hostKeyErr)
+	if err != nil {
+		return nil, timings, err
+	}
+	start := time.Now()
+	conn, err := dialVia(ctx, jump, c.Addr)
+	timings.Connect = time.Since(start)
+	if err != nil {
+		return nil, timings, err
+	}
+	start = time.Now()
+	client, err := handshake(ctx, conn, c.Addr, sshConfig)
+	timings.Handshake = time.Since(start)
+	if err != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			return nil, timings, hostKeyErr
 		}
-		TimeoutConn := &TimeoutConn{conn, c.Timeout, c.Timeout}
-		cli, chans, reqs, err := ssh.NewClientConn(TimeoutConn, c.Addr, sshConfig)
-		if err != nil {
-			c.sshError = err
-			return
+		return nil, timings, err
+	}
+	return client, timings, nil
+}
+
+// handshake does the handshake until the deadline of the ctx, a cancelled ctx expires the deadline
+// at once. The deadline is cleared once it's done, the idle shared connection is watched by the
+// keepalives, not by the deadlines of its reads.
+func handshake(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
 		}
-		client := ssh.NewClient(cli, chans, reqs)
-		c.sshclient = client
-		c.sshError = nil
-		go func() {
-			t := time.NewTicker(3 * time.Second)
-			defer t.Stop()
-			for {
-				<-t.C
-				_, _, err := client.Conn.SendRequest("keepalive@epicon.com", true, nil)
-				if err != nil {
-					return
-				}
-			}
-		}()
-	})
-	return c.sshError
+	}()
+	cli, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(done)
+	<-watched
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(cli, chans, reqs), nil
 }
 
+// Close leaves the shared connection to the other clients. The client doesn't hold it between
+// the runs, the pool closes it once it's unused for the IdleTimeout.
 func (c *SSHClient) Close() {
-	c.sshclient.Close()
+	c.initClient = &sync.Once{}
 }
 
-func (c *SSHClient) Run(dir, command string, args ...string) (string, error) {
-	err := c.Connect()
+// newSession opens a session on the shared connection, release must be called once it's closed.
+// The timings are those of the connection if it's dialed for the session.
+func (c *SSHClient) newSession(ctx context.Context) (session *ssh.Session, release func(), dialed util.Timings, err error) {
+	conn, dialed, err := c.open(ctx, func(conn *conn) (err error) {
+		session, err = conn.newSession(ctx, c.Timeout)
+		return err
+	})
 	if err != nil {
-		err = c.Reconnect() // always Reconnect if it's failed in first connect
-		if err != nil {
-			return "", err
-		}
+		return nil, nil, dialed, err
 	}
-	// start := time.Now()
-	session, err := c.sshclient.NewSession()
+	return session, func() {
+		conn.release()
+		conn.put()
+	}, dialed, nil
+}
+
+// DialUnix opens a channel to the unix socket on the remote host through the shared connection,
+// like the docker socket. The connection is kept until the channel is closed.
+func (c *SSHClient) DialUnix(path string) (net.Conn, error) {
+	var channel net.Conn
+	conn, _, err := c.open(context.Background(), func(conn *conn) (err error) {
+		channel, err = conn.dial("unix", path)
+		return err
+	})
 	if err != nil {
-		c.sshError = err
-		return "", err
+		return nil, err
 	}
+	return &channelConn{Conn: channel, unuse: conn.put}, nil
+}
+
+// open gets the shared connection from the pool and opens a session or a channel on it. The
+// connection is dialed again if it has died or been evicted meanwhile. It's held until put.
+func (c *SSHClient) open(ctx context.Context, open func(conn *conn) error) (*conn, util.Timings, error) {
+	conn, dialed, err := c.get(ctx)
 	if err != nil {
-		c.sshError = err
-		return "", err
+		return nil, dialed, err
 	}
+	err = open(conn)
+	if err == errConnClosed {
+		conn.put()
+		if conn, dialed, err = c.get(ctx); err != nil {
+			return nil, dialed, err
+		}
+		err = open(conn)
+	}
+	if err != nil {
+		conn.put()
+		return nil, dialed, err
+	}
+	return conn, dialed, nil
+}
 
-	var stdoutB bytes.Buffer
-	session.Stdout = &stdoutB
-	var stderrB bytes.Buffer
-	session.Stderr = &stderrB
+// Run runs the command with the Timeout
+func (c *SSHClient) Run(dir, command string, args ...string) (*util.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.RunContext(ctx, &util.RunRequest{Dir: dir, Command: command, Args: args})
+}
 
-	err = session.Run(util.BuildCmd(dir, command, args...))
+// RunContext runs the request in a session, the dial, the wait for a free session and the session
+// are stopped once the ctx is done.
+// A script is uploaded through the stdin of a session first, and removed after the run.
+func (c *SSHClient) RunContext(ctx context.Context, req *util.RunRequest) (*util.Result, error) {
+	start := time.Now()
+	// the connection is dialed by the upload or by the session of the command, if it's not pooled
+	var dialed util.Timings
+	command, args := req.Command, req.Args
+	if req.Script != nil {
+		path, uploadDialed, err := c.upload(ctx, req.Script)
+		if err != nil {
+			return nil, err
+		}
+		defer c.remove(path)
+		dialed = uploadDialed
+		command, args = util.ScriptCommand(req.Interpreter, path, args)
+	}
 
+	session, release, sessionDialed, err := c.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dialed.Connect += sessionDialed.Connect
+	dialed.Handshake += sessionDialed.Handshake
+	defer release()
 	defer session.Close()
+
+	if c.forwardAgent() {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return nil, err
+		}
+	}
+
+	session.Stdin = req.Stdin
+	outputs := util.NewOutputs(req)
+	session.Stdout = outputs.StdoutWriter
+	session.Stderr = outputs.Stderr
+
+	// the variables are accepted by the AcceptEnv of sshd
+	rejected := map[string]string{}
+	for name, value := range c.Env {
+		if err := session.Setenv(name, value); err != nil {
+			rejected[name] = value
+		}
+	}
+
+	execStart := time.Now()
+	err = runSession(ctx, session, util.ExportEnv(rejected, util.BuildCmd(c.Shell, req.Dir, command, args...)))
+	end := time.Now()
+
+	result := &util.Result{
+		Timings: util.Timings{
+			Start:     start,
+			Connect:   dialed.Connect,
+			Handshake: dialed.Handshake,
+			Exec:      end.Sub(execStart),
+			Total:     end.Sub(start),
+		},
+		Metadata: map[string]interface{}{"addr": c.Addr},
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		// the command has been run, the exit status is part of the result
+		result.ExitCode = exitErr.ExitStatus()
+		err = nil
+	}
 	if err != nil {
-		c.sshError = err
+		if ctx.Err() != nil {
+			// only the session is killed, the connection is still usable
+			return nil, fmt.Errorf("The command is killed: %v", ctx.Err())
+		}
 		exitErr := &ssh.ExitMissingError{}
 		if err.Error() == exitErr.Error() {
-			return "", fmt.Errorf("Connection is disconnected by the Timeout or lost")
+			return nil, fmt.Errorf("Connection is disconnected by the Timeout or lost")
 		}
-		return "", fmt.Errorf("%v %v", string(stderrB.Bytes()), err.Error())
+		return nil, fmt.Errorf("%v %v", outputs.Stderr.String(), err.Error())
 	}
-	// fmt.Println(time.Since(start))
-	if stderrB.Len() == 0 {
-		c.sshError = nil
-		err = nil
-	} else {
-		err = fmt.Errorf("%v", string(stderrB.Bytes()))
-		c.sshError = err
+	outputs.SetResult(result)
+	result.Stdout = strings.Trim(result.Stdout, "\n")
+	result.Stderr = strings.Trim(result.Stderr, "\n")
+	return result, nil
+
+}
+
+// runSession runs the command in the session until it exits or the ctx is done
+func runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return <-done
+	}
+}
+
+// upload saves the data into a new remote temporary file and returns its path, with the timings
+// of the connection if it's dialed for the upload
+func (c *SSHClient) upload(ctx context.Context, data []byte) (string, util.Timings, error) {
+	session, release, dialed, err := c.newSession(ctx)
+	if err != nil {
+		return "", dialed, err
+	}
+	defer release()
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := runSession(ctx, session, util.UploadScriptCmd); err != nil {
+		return "", dialed, fmt.Errorf("Failed to upload the script: %v %v", strings.TrimSpace(stderr.String()), err)
+	}
+	path := strings.TrimSpace(stdout.String())
+	if path == "" {
+		return "", dialed, fmt.Errorf("Failed to upload the script: no temporary file is created")
 	}
-	return strings.Trim(string(stdoutB.Bytes()), "\n"), err
+	return path, dialed, nil
+}
 
+// remove removes the remote file, even after the run is cancelled
+func (c *SSHClient) remove(path string) {
+	c.Run("", "rm", "-f", path)
 }
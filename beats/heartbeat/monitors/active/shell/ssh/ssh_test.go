@@ -1,11 +1,17 @@
 package ssh
 
 import (
+	"context"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/elastic/beats/heartbeat/monitors/active/shell/util"
 )
 
 var (
@@ -20,6 +26,7 @@ func Test_run_output(t *testing.T) {
 		Username:   "root",
 		Password:   "XXX",
 		Timeout:    2 * time.Second,
+		Shell:      true,
 		initClient: &sync.Once{},
 	}
 
@@ -28,8 +35,8 @@ func Test_run_output(t *testing.T) {
 	comm.Run("~", "echo 'echo test test1' >test.sh")
 	comm.Run("~", "chmod 755 test.sh")
 	out, err := comm.Run("~", "/bin/bash", "test.sh")
-	assert.Equal(t, "test test1\n", out)
-	assert.NoError(t, err, "Failed by running comm.Output")
+	require.NoError(t, err, "Failed by running comm.Output")
+	assert.Equal(t, "test test1\n", out.Stdout)
 }
 
 func Test_timeout(t *testing.T) {
@@ -38,14 +45,15 @@ func Test_timeout(t *testing.T) {
 		Username:   "root",
 		Password:   "XXX",
 		Timeout:    2 * time.Second,
+		Shell:      true,
 		initClient: &sync.Once{},
 	}
 
 	_, err := comm.Run("", "sleep 5")
 	assert.EqualError(t, err, "Connection is disconnected by the timeout or lost")
 	out, err := comm.Run("", "echo", "test", "test1")
-	assert.Equal(t, "test test1", out)
-	assert.NoError(t, err, "Failed by running timeout test")
+	require.NoError(t, err, "Failed by running timeout test")
+	assert.Equal(t, "test test1", out.Stdout)
 }
 
 func Test_Key(t *testing.T) {
@@ -54,13 +62,14 @@ func Test_Key(t *testing.T) {
 		Username: "root",
 		Password: "XXX",
 		Key:      keydata,
+		Shell:    true,
 
 		initClient: &sync.Once{},
 	}
 
 	out, err := comm.Run("", "echo", "test", "test1")
-	assert.Equal(t, "test test1", out)
-	assert.NoError(t, err, "Failed by running timeout test")
+	require.NoError(t, err, "Failed by running timeout test")
+	assert.Equal(t, "test test1", out.Stdout)
 }
 
 func Test_Key_file(t *testing.T) {
@@ -69,10 +78,91 @@ func Test_Key_file(t *testing.T) {
 		Username:   "root",
 		Key:        "@/Users/user/.ssh/id_rsa",
 		Timeout:    1 * time.Second,
+		Shell:      true,
 		initClient: &sync.Once{},
 	}
 
 	out, err := comm.Run("", "ps aux | grep ipa | wc -l")
-	assert.Equal(t, "test test1", out)
-	assert.NoError(t, err, "Failed by running timeout test")
+	require.NoError(t, err, "Failed by running timeout test")
+	assert.Equal(t, "test test1", out.Stdout)
+}
+
+// serveExec runs an ssh server on listener without authentication, every exec prints its command
+func serveExec(t *testing.T, listener net.Listener) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newSigner(t))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func() {
+					defer channel.Close()
+					for req := range requests {
+						if req.Type != "exec" {
+							req.Reply(false, nil)
+							continue
+						}
+						req.Reply(true, nil)
+						channel.Write(req.Payload[4:])
+						channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+						return
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func Test_run_concurrent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go serveExec(t, listener)
+
+	client := NewSSHClient()
+	client.Addr = listener.Addr().String()
+	client.Username = "monitor"
+	client.Password = "secret"
+	client.HostKeyPolicy = HostKeyInsecure
+	client.Timeout = 5 * time.Second
+
+	// the timings of the dial are only reported by the run which dialed the connection
+	var wg sync.WaitGroup
+	results := make([]*util.Result, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := client.RunContext(context.Background(), &util.RunRequest{Command: "echo", Args: []string{"ok"}})
+			if assert.NoError(t, err) {
+				results[i] = result
+			}
+		}(i)
+	}
+	wg.Wait()
+	dialed := 0
+	for _, result := range results {
+		require.NotNil(t, result)
+		assert.Equal(t, "echo ok", result.Stdout)
+		if result.Timings.Handshake > 0 {
+			dialed++
+		}
+	}
+	assert.True(t, dialed > 0)
 }
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EnvList returns the environment as sorted NAME=value entries
+func EnvList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ExportEnv prefixes the shell command line with the export of the environment,
+// for the remote shells which don't accept the environment.
+func ExportEnv(env map[string]string, cmd string) string {
+	if len(env) == 0 {
+		return cmd
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	words := make([]string, len(names))
+	for i, name := range names {
+		words[i] = name + "=" + Quote(env[name])
+	}
+	return fmt.Sprintf("export %v; %v", strings.Join(words, " "), cmd)
+}
+
+// ValidEnvName is true for the names which can be exported by a POSIX shell
+func ValidEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"fmt"
+	"io"
+)
+
+// OutputBuffer keeps the head and the tail of an output up to max bytes, 0 is unlimited.
+// The bytes between them are counted and dropped as they are written.
+type OutputBuffer struct {
+	max   int
+	head  []byte
+	tail  []byte
+	total int64
+}
+
+func NewOutputBuffer(max int) *OutputBuffer {
+	return &OutputBuffer{max: max}
+}
+
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if b.max <= 0 {
+		b.head = append(b.head, p...)
+		return len(p), nil
+	}
+
+	rest := p
+	if n := b.headMax() - len(b.head); n > 0 {
+		if n > len(rest) {
+			n = len(rest)
+		}
+		b.head = append(b.head, rest[:n]...)
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		// the tail is compacted once it's twice its size, the memory stays bounded
+		tailMax := b.max - b.headMax()
+		b.tail = append(b.tail, rest...)
+		if len(b.tail) > 2*tailMax {
+			b.tail = append(b.tail[:0], b.tail[len(b.tail)-tailMax:]...)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *OutputBuffer) headMax() int {
+	return b.max / 2
+}
+
+// Len is the size of the whole output
+func (b *OutputBuffer) Len() int64 {
+	return b.total
+}
+
+// Truncated is true once the output is longer than max bytes
+func (b *OutputBuffer) Truncated() bool {
+	return b.max > 0 && b.total > int64(b.max)
+}
+
+// String returns the output, a truncated output is the head and the tail joined by a marker line
+func (b *OutputBuffer) String() string {
+	if !b.Truncated() {
+		return string(b.head) + string(b.tail)
+	}
+	tail := b.tail[len(b.tail)-(b.max-b.headMax()):]
+	dropped := b.total - int64(len(b.head)+len(tail))
+	return fmt.Sprintf("%s\n... %d bytes truncated ...\n%s", b.head, dropped, tail)
+}
+
+// Outputs are the buffers of the stdout and stderr of a run
+type Outputs struct {
+	Stdout *OutputBuffer
+	Stderr *OutputBuffer
+	// StdoutWriter writes to Stdout, and streams the whole stdout to the Output of the request
+	StdoutWriter io.Writer
+}
+
+func NewOutputs(req *RunRequest) *Outputs {
+	o := &Outputs{
+		Stdout: NewOutputBuffer(req.MaxBytes),
+		Stderr: NewOutputBuffer(req.MaxBytes),
+	}
+	o.StdoutWriter = o.Stdout
+	if req.Output != nil {
+		o.StdoutWriter = io.MultiWriter(o.Stdout, req.Output)
+	}
+	return o
+}
+
+// SetResult sets the outputs and their sizes in the result
+func (o *Outputs) SetResult(result *Result) {
+	result.Stdout = o.Stdout.String()
+	result.Stderr = o.Stderr.String()
+	result.StdoutBytes = o.Stdout.Len()
+	result.StderrBytes = o.Stderr.Len()
+	result.Truncated = o.Stdout.Truncated() || o.Stderr.Truncated()
+}
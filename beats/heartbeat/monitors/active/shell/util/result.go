@@ -0,0 +1,57 @@
+package util
+
+import (
+	"io"
+	"time"
+)
+
+// RunRequest is a command, or a script, run by a shell client.
+type RunRequest struct {
+	Dir     string
+	Command string
+	Args    []string
+
+	// Script is run by the Interpreter instead of the Command, the Args are passed to it
+	Script      []byte
+	Interpreter string
+
+	// Stdin is streamed to the command, nil is empty
+	Stdin io.Reader
+
+	// MaxBytes keeps the head and the tail of each output up to MaxBytes, 0 is unlimited
+	MaxBytes int
+	// Output receives the whole stdout as it's read, before it's truncated
+	Output io.Writer
+}
+
+// Result is the outcome of a command executed by a shell client.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+
+	// StdoutBytes and StderrBytes are the sizes of the whole outputs, Truncated is set once
+	// any of them is longer than the MaxBytes of the request
+	StdoutBytes int64
+	StderrBytes int64
+	Truncated   bool
+
+	Timings Timings
+
+	// Metadata describes where the command was run, like the remote address or the container
+	Metadata map[string]interface{}
+}
+
+// Timings are the durations of a run
+type Timings struct {
+	// Start is the start of the run
+	Start time.Time
+	// Connect is the connection to the host and Handshake its authentication, they are 0
+	// when the run uses an open connection
+	Connect   time.Duration
+	Handshake time.Duration
+	// Exec is the execution of the command
+	Exec time.Duration
+	// Total is the whole run, including the connection
+	Total time.Duration
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultInterpreter runs the scripts without interpreter
+	DefaultInterpreter = "/bin/sh"
+
+	scriptPrefix = "shell_monitor_script_"
+
+	// UploadScriptCmd saves its stdin into a new private file and prints its path
+	UploadScriptCmd = `f=$(mktemp "${TMPDIR:-/tmp}/` + scriptPrefix + `XXXXXX") && cat > "$f" && chmod 700 "$f" && echo "$f"`
+)
+
+// ScriptCommand returns the command and args running the script at path with the interpreter,
+// the interpreter can have its own args like "/usr/bin/env python3".
+func ScriptCommand(interpreter, path string, args []string) (string, []string) {
+	words := strings.Fields(interpreter)
+	if len(words) == 0 {
+		words = []string{DefaultInterpreter}
+	}
+	scriptArgs := append(append(words[1:len(words):len(words)], path), args...)
+	return words[0], scriptArgs
+}
+
+// WriteTempScript writes the script into a new private temporary file, it must be removed by the caller.
+func WriteTempScript(script []byte) (string, error) {
+	f, err := ioutil.TempFile("", scriptPrefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(script)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// ScriptHash is the SHA256 of the script recorded in the events
+func ScriptHash(script []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(script))
+}
@@ -5,10 +5,54 @@ import (
 	"strings"
 )
 
-func BuildCmd(dir, command string, args ...string) string {
+// BuildCmd builds the shell command line running the command with args in dir. With shell,
+// the command is a raw shell snippet, otherwise it's the program of an argv and quoted like
+// the args. The dir keeps a leading ~ to expand it to the home directory.
+func BuildCmd(shell bool, dir, command string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	if shell {
+		words = append(words, command)
+	} else {
+		words = append(words, Quote(command))
+	}
+	for _, arg := range args {
+		words = append(words, Quote(arg))
+	}
+	cmd := strings.Join(words, " ")
+
 	if dir != "" {
-		return fmt.Sprintf("cd %v && %v %v", dir, command, strings.Join(args, " "))
+		return fmt.Sprintf("cd %v && %v", quoteDir(dir), cmd)
 	}
+	return cmd
+}
 
-	return fmt.Sprintf("%v %v", command, strings.Join(args, " "))
+// Quote quotes s as a single word for a POSIX shell, the words without special
+// characters are kept as they are.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, isSpecial) < 0 {
+		return s
+	}
+	// a single quote can't be escaped inside single quotes, it's closed, escaped and reopened
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func quoteDir(dir string) string {
+	if dir == "~" {
+		return dir
+	}
+	if strings.HasPrefix(dir, "~/") {
+		return "~/" + Quote(dir[2:])
+	}
+	return Quote(dir)
+}
+
+func isSpecial(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("_-+=.,:/@%", r)
 }
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nastyArgs = []string{
+	"",
+	" ",
+	"two words",
+	"it's",
+	"'",
+	"''",
+	`"double"`,
+	"$HOME",
+	"${PATH}",
+	"`id`",
+	"$(id)",
+	"a;b",
+	"a && b",
+	"a | b",
+	"> /tmp/out",
+	"*",
+	"~",
+	"\\",
+	"back\\slash",
+	"line\nbreak",
+	"tab\there",
+	"-n",
+	"!",
+	"#comment",
+	"é ünïcode",
+}
+
+func Test_quote(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"", "''"},
+		{"plain", "plain"},
+		{"/usr/bin/env", "/usr/bin/env"},
+		{"key=value,a:b@c%d+e-f_g.h", "key=value,a:b@c%d+e-f_g.h"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+		{"'", `''\'''`},
+		{"$HOME", "'$HOME'"},
+		{"`id`", "'`id`'"},
+		{"a;b", "'a;b'"},
+		{"~", "'~'"},
+		{"line\nbreak", "'line\nbreak'"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, Quote(c.in), "quote %q", c.in)
+	}
+}
+
+func Test_build_cmd(t *testing.T) {
+	cases := []struct {
+		shell   bool
+		dir     string
+		command string
+		args    []string
+		want    string
+	}{
+		{true, "", "echo", nil, "echo"},
+		{true, "", "ps aux | wc -l", nil, "ps aux | wc -l"},
+		{true, "", "echo", []string{"test", "test1"}, "echo test test1"},
+		{true, "", "echo", []string{"$(id)"}, "echo '$(id)'"},
+		{false, "", "my command", []string{"a b"}, "'my command' 'a b'"},
+		{false, "", "ps aux | wc -l", nil, "'ps aux | wc -l'"},
+		{true, "/tmp", "ls", nil, "cd /tmp && ls"},
+		{true, "/tmp/my dir", "ls", nil, "cd '/tmp/my dir' && ls"},
+		{true, "/tmp; rm -rf /", "ls", nil, "cd '/tmp; rm -rf /' && ls"},
+		{true, "~", "ls", nil, "cd ~ && ls"},
+		{true, "~/my dir", "ls", nil, "cd ~/'my dir' && ls"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, BuildCmd(c.shell, c.dir, c.command, c.args...))
+	}
+}
+
+// Test_build_cmd_shell runs the command lines to check that every arg is passed as it is.
+func Test_build_cmd_shell(t *testing.T) {
+	for _, shell := range []bool{true, false} {
+		for _, arg := range nastyArgs {
+			cmd := BuildCmd(shell, "", "printf", "[%s]", arg)
+			out, err := exec.Command("/bin/sh", "-c", cmd).Output()
+			assert.NoError(t, err, cmd)
+			assert.Equal(t, "["+arg+"]", string(out), cmd)
+		}
+	}
+
+	args := append([]string{"%s\n"}, nastyArgs...)
+	out, err := exec.Command("/bin/sh", "-c", BuildCmd(false, "/", "printf", args...)).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(nastyArgs, "\n")+"\n", string(out))
+}
+
+func Test_export_env(t *testing.T) {
+	env := map[string]string{
+		"PGPASSWORD": "it's $secret",
+		"EMPTY":      "",
+		"PATH":       "/opt/bin:/usr/bin:/bin",
+	}
+	assert.Equal(t, []string{"EMPTY=", "PATH=/opt/bin:/usr/bin:/bin", "PGPASSWORD=it's $secret"}, EnvList(env))
+
+	cmd := ExportEnv(env, BuildCmd(false, "", "printf", "%s|%s|%s", "$EMPTY", "$PATH", "$PGPASSWORD"))
+	assert.Equal(t, `export EMPTY='' PATH=/opt/bin:/usr/bin:/bin PGPASSWORD='it'\''s $secret'; printf '%s|%s|%s' '$EMPTY' '$PATH' '$PGPASSWORD'`, cmd)
+
+	out, err := exec.Command("/bin/sh", "-c", ExportEnv(env, `printf '%s|%s|%s' "$EMPTY" "$PATH" "$PGPASSWORD"`)).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "|/opt/bin:/usr/bin:/bin|it's $secret", string(out))
+
+	assert.Equal(t, "echo", ExportEnv(nil, "echo"))
+}
+
+func Test_valid_env_name(t *testing.T) {
+	for _, name := range []string{"PATH", "_X", "kube_config2"} {
+		assert.True(t, ValidEnvName(name), name)
+	}
+	for _, name := range []string{"", "2X", "A-B", "A B", "A=B", "$A"} {
+		assert.False(t, ValidEnvName(name), name)
+	}
+}
+
+func Test_script_command(t *testing.T) {
+	command, args := ScriptCommand("", "/tmp/script", []string{"a b"})
+	assert.Equal(t, "/bin/sh", command)
+	assert.Equal(t, []string{"/tmp/script", "a b"}, args)
+
+	command, args = ScriptCommand("/usr/bin/env  python3", "/tmp/script", nil)
+	assert.Equal(t, "/usr/bin/env", command)
+	assert.Equal(t, []string{"python3", "/tmp/script"}, args)
+}
+
+func Test_upload_script(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", UploadScriptCmd)
+	cmd.Stdin = strings.NewReader("echo uploaded\n")
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	path := strings.TrimSpace(string(out))
+	defer os.Remove(path)
+
+	out, err = exec.Command("/bin/sh", path).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "uploaded\n", string(out))
+}
+
+func Test_output_buffer(t *testing.T) {
+	b := NewOutputBuffer(0)
+	b.Write([]byte(strings.Repeat("x", 1000)))
+	assert.False(t, b.Truncated())
+	assert.Equal(t, int64(1000), b.Len())
+	assert.Len(t, b.String(), 1000)
+
+	b = NewOutputBuffer(10)
+	b.Write([]byte("0123456789"))
+	assert.False(t, b.Truncated())
+	assert.Equal(t, "0123456789", b.String())
+
+	// the writes can be smaller or larger than the buffer
+	b = NewOutputBuffer(10)
+	for _, chunk := range []string{"ab", "cdefgh", strings.Repeat("-", 100), "uvw", "xyz"} {
+		b.Write([]byte(chunk))
+	}
+	assert.True(t, b.Truncated())
+	assert.Equal(t, int64(114), b.Len())
+	assert.Equal(t, "abcde\n... 104 bytes truncated ...\nvwxyz", b.String())
+	assert.True(t, len(b.tail) <= 2*5)
+
+	var whole bytes.Buffer
+	outputs := NewOutputs(&RunRequest{MaxBytes: 4, Output: &whole})
+	outputs.StdoutWriter.Write([]byte("0123456789"))
+	outputs.Stderr.Write([]byte("err"))
+	result := &Result{}
+	outputs.SetResult(result)
+	assert.Equal(t, "01\n... 6 bytes truncated ...\n89", result.Stdout)
+	assert.Equal(t, "err", result.Stderr)
+	assert.Equal(t, int64(10), result.StdoutBytes)
+	assert.Equal(t, int64(3), result.StderrBytes)
+	assert.True(t, result.Truncated)
+	assert.Equal(t, "0123456789", whole.String())
+}